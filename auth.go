@@ -0,0 +1,163 @@
+package GoDistributedCache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signatureHeader carries "<unix seconds>:<nonce>:<hex HMAC-SHA256>"
+	// on peer requests of a pool with a shared secret
+	signatureHeader = "X-Cache-Signature"
+	// maxSignatureAge bounds the clock skew between peers. A pool remembers
+	// the nonces it accepted for twice as long, so a captured request
+	// cannot be replayed while its signature is fresh.
+	maxSignatureAge = time.Minute
+)
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// NewMutualTLSConfig loads this node's certificate and the CA that signs
+// every peer's certificate, for WithTLS and the server serving the pool.
+// Peers then only talk to, and only answer, holders of such a certificate.
+// Peers are dialed by IP, which changes as pods come and go, so their
+// certificate is checked against serverName instead, e.g. the name of the
+// headless service, which every peer certificate must carry as a DNS SAN.
+func NewMutualTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   serverName,
+		RootCAs:      ca,
+		ClientCAs:    ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// signature is the HMAC of everything that makes a peer request, so a
+// signed GET cannot be turned into a PUT or sent for another key.
+func signature(secret []byte, method, path string, ts int64, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%x", method, path, ts, nonce, sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest signs req, whose body is body, with secret.
+func signRequest(req *http.Request, secret, body []byte, now time.Time) {
+	var b [16]byte
+	rand.Read(b[:])
+	ts, nonce := now.Unix(), hex.EncodeToString(b[:])
+	req.Header.Set(signatureHeader, fmt.Sprintf("%d:%s:%s", ts, nonce, signature(secret, req.Method, req.URL.EscapedPath(), ts, nonce, body)))
+}
+
+// parseSignature returns the timestamp, nonce and signature r carries,
+// checking that it was signed less than maxSignatureAge ago.
+func parseSignature(r *http.Request, now time.Time) (ts int64, nonce, sig string, err error) {
+	parts := strings.Split(r.Header.Get(signatureHeader), ":")
+	if len(parts) != 3 || parts[1] == "" {
+		return 0, "", "", fmt.Errorf("%w: missing %s", errUnauthenticated, signatureHeader)
+	}
+	if ts, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, "", "", fmt.Errorf("%w: bad %s", errUnauthenticated, signatureHeader)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return 0, "", "", fmt.Errorf("%w: signature is %v old", errUnauthenticated, age.Round(time.Second))
+	}
+	return ts, parts[1], parts[2], nil
+}
+
+// verifyRequest checks that r, whose body is body, was signed with secret
+// less than maxSignatureAge ago, and returns its nonce.
+func verifyRequest(r *http.Request, secret, body []byte, now time.Time) (string, error) {
+	ts, nonce, sig, err := parseSignature(r, now)
+	if err != nil {
+		return "", err
+	}
+	want := signature(secret, r.Method, r.URL.EscapedPath(), ts, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", fmt.Errorf("%w: bad signature", errUnauthenticated)
+	}
+	return nonce, nil
+}
+
+// nonceSet holds the nonces of the signed requests a pool accepted. Nonces
+// move to prev, and are then forgotten, every 2*maxSignatureAge, so each
+// is kept at least as long as a request carrying it passes parseSignature.
+type nonceSet struct {
+	mu        sync.Mutex
+	cur, prev map[string]bool
+	rotated   time.Time
+}
+
+// add records nonce, reporting false if it was already there.
+func (s *nonceSet) add(nonce string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil || now.Sub(s.rotated) >= 2*maxSignatureAge {
+		s.prev, s.cur, s.rotated = s.cur, make(map[string]bool), now
+	}
+	if s.cur[nonce] || s.prev[nonce] {
+		return false
+	}
+	s.cur[nonce] = true
+	return true
+}
+
+// admit turns away peer requests that authenticate is bound to reject,
+// before their body is read: those without a verified client certificate
+// or a fresh signature.
+func (p *HTTPPool) admit(r *http.Request) error {
+	if p.tlsConfig != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return fmt.Errorf("%w: no verified client certificate", errUnauthenticated)
+	}
+	if p.secret != nil {
+		_, _, _, err := parseSignature(r, time.Now())
+		return err
+	}
+	return nil
+}
+
+// authenticate checks a peer request against the pool's TLS and shared
+// secret settings, body being the request's body.
+func (p *HTTPPool) authenticate(r *http.Request, body []byte) error {
+	if err := p.admit(r); err != nil {
+		return err
+	}
+	if p.secret != nil {
+		now := time.Now()
+		nonce, err := verifyRequest(r, p.secret, body, now)
+		if err != nil {
+			return err
+		}
+		// 只有签名正确的请求才记录 nonce，伪造的请求占不了内存
+		if !p.nonces.add(nonce, now) {
+			return fmt.Errorf("%w: replayed request", errUnauthenticated)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// A BatchGetter loads many keys at once, e.g. with a single database
+// query. Keys left out of the result are treated as ErrNotFound.
+type BatchGetter interface {
+	Getter
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+}
+
+// GetMulti is GetMultiContext with a background context.
+func (g *Group) GetMulti(keys []string) (map[string]ByteView, error) {
+	return g.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext looks keys up like GetContext, but sends one request to
+// each peer owning some of the missed keys and, if the Getter is a
+// BatchGetter, loads the rest with a single call. Keys that could not be
+// loaded are left out of the result, and their errors joined in err.
+//
+// The batch does not go through singleflight, which works per key: a miss
+// that a concurrent Get or GetMulti is already loading is loaded again.
+func (g *Group) GetMultiContext(ctx context.Context, keys []string) (map[string]ByteView, error) {
+	res, failed := g.getMulti(ctx, keys)
+	errs := make([]error, 0, len(failed))
+	for _, key := range keys {
+		if err, ok := failed[key]; ok {
+			errs = append(errs, err)
+			delete(failed, key)
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// getMulti returns the values of keys, and the error of every key it could
+// not load.
+func (g *Group) getMulti(ctx context.Context, keys []string) (map[string]ByteView, map[string]error) {
+	res := make(map[string]ByteView, len(keys))
+	failed := make(map[string]error)
+	var missed []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			failed[key] = fmt.Errorf("key is required")
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if v, ok := g.lookupCache(key); ok {
+			res[key] = v
+			continue
+		}
+		if g.knownMissing(key) {
+			failed[key] = errNotFound(key)
+			continue
+		}
+		missed = append(missed, key)
+	}
+
+	var local []string
+	// owned are the keys of local this node owns, rather than falls back on
+	owned := make(map[string]bool)
+	byPeer := make(map[PeerGetter][]string)
+	for _, key := range missed {
+		g.stats.loads.Add(1)
+		g.stats.loadsRun.Add(1)
+		g.promoter.record(key)
+		if v, ok := g.getFromDisk(key); ok {
+			g.stats.diskHits.Add(1)
+			res[key] = v
+			continue
+		}
+		if g.peers != nil {
+			if peer, ok := g.peers.PickPeer(key); ok {
+				byPeer[peer] = append(byPeer[peer], key)
+				continue
+			}
+		}
+		owned[key] = true
+		local = append(local, key)
+	}
+
+	// 每个 peer 只发一次批量请求，各 peer 之间并发
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for peer, keys := range byPeer {
+		wg.Add(1)
+		go func(peer PeerGetter, keys []string) {
+			defer wg.Done()
+			out := &pb.BatchResponse{}
+			err := peer.GetMulti(ctx, &pb.BatchRequest{Group: g.name, Keys: keys}, out)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				g.stats.peerErrors.Add(1)
+				if !fallBackLocally(err) {
+					for _, key := range keys {
+						failed[key] = err
+					}
+					return
+				}
+				log.Println("[GeeCache] Failed to get from peer", err)
+				local = append(local, keys...)
+				return
+			}
+			for _, key := range keys {
+				r, ok := out.GetValues()[key]
+				if !ok {
+					local = append(local, key)
+					continue
+				}
+				v, err := g.peerValue(key, r)
+				switch {
+				case err == nil:
+					g.stats.peerLoads.Add(1)
+					res[key] = v
+				case errors.Is(err, ErrNotFound):
+					g.stats.peerLoads.Add(1)
+					failed[key] = err
+				case fallBackLocally(err):
+					g.stats.peerErrors.Add(1)
+					local = append(local, key)
+				default:
+					g.stats.peerErrors.Add(1)
+					failed[key] = err
+				}
+			}
+		}(peer, keys)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		for _, key := range local {
+			failed[key] = err
+		}
+		return res, failed
+	}
+
+	g.getMultiLocally(ctx, local, res, failed)
+	if g.replicas > 1 {
+		for _, key := range local {
+			if v, ok := res[key]; ok && owned[key] {
+				go g.replicate(key, v)
+			}
+		}
+	}
+	return res, failed
+}
+
+// getMultiLocally loads keys with the Getter into res, in one call if it is
+// a BatchGetter, and their errors into failed.
+func (g *Group) getMultiLocally(ctx context.Context, keys []string, res map[string]ByteView, failed map[string]error) {
+	if len(keys) == 0 {
+		return
+	}
+	bg, ok := g.getter.(BatchGetter)
+	if !ok {
+		for _, key := range keys {
+			value, err := g.getLocally(ctx, key)
+			if err != nil {
+				g.stats.localLoadErrs.Add(1)
+				failed[key] = err
+				continue
+			}
+			g.stats.localLoads.Add(1)
+			res[key] = value
+		}
+		return
+	}
+
+	values, err := bg.GetMulti(ctx, keys)
+	for _, key := range keys {
+		if err != nil {
+			g.stats.localLoadErrs.Add(1)
+			failed[key] = err
+			continue
+		}
+		b, ok := values[key]
+		if !ok {
+			g.stats.localLoadErrs.Add(1)
+			g.populateNegativeCache(key)
+			failed[key] = errNotFound(key)
+			continue
+		}
+		g.stats.localLoads.Add(1)
+		value := ByteView{b: cloneBytes(b), e: g.expireAfter(0)}
+		g.populateCache(key, value)
+		res[key] = value
+	}
+}
+
+// serveGetMulti answers a peer's batch request. Keys that do not exist or
+// failed to load are sent back with the Status of their error.
+func (g *Group) serveGetMulti(ctx context.Context, keys []string) *pb.BatchResponse {
+	for _, key := range keys {
+		g.servePeer(key)
+	}
+	values, failed := g.getMulti(ctx, keys)
+	out := &pb.BatchResponse{Values: make(map[string]*pb.Response, len(values))}
+	for key, v := range values {
+		out.Values[key] = &pb.Response{Value: v.ByteSlice(), Expire: expireToNano(v.Expire())}
+	}
+	for key, err := range failed {
+		if errors.Is(err, ErrNotFound) {
+			out.Values[key] = &pb.Response{Status: pb.Status_NOT_FOUND}
+		} else {
+			out.Values[key] = &pb.Response{Status: statusOf(err), Error: err.Error()}
+		}
+	}
+	return out
+}
@@ -0,0 +1,250 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, without asking the peer, for requests to a
+// peer whose circuit breaker is open. Group falls back to its Getter.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig configures the circuit breaker HTTPPool puts in front of
+// each peer. Zero fields take the defaults in DefaultBreakerConfig.
+type BreakerConfig struct {
+	// Window is how long requests are counted before the counts restart.
+	Window time.Duration
+	// MinRequests is how many requests a window needs before the breaker
+	// may open, so a single failure on a quiet peer does not trip it.
+	MinRequests int
+	// ErrorRate is the share of failed requests that opens the breaker.
+	ErrorRate float64
+	// SlowCall is how long a request may take before it counts as slow,
+	// and SlowRate the share of slow requests that opens the breaker.
+	SlowCall time.Duration
+	SlowRate float64
+	// CoolDown is how long the breaker stays open before it lets a single
+	// trial request through.
+	CoolDown time.Duration
+}
+
+// DefaultBreakerConfig is the circuit breaker HTTPPool uses unless told
+// otherwise with WithCircuitBreaker.
+var DefaultBreakerConfig = BreakerConfig{
+	Window:      10 * time.Second,
+	MinRequests: 20,
+	ErrorRate:   0.5,
+	SlowCall:    time.Second,
+	SlowRate:    0.8,
+	CoolDown:    5 * time.Second,
+}
+
+type breakerState int
+
+const (
+	// breakerClosed lets every request through and counts the outcomes
+	breakerClosed breakerState = iota
+	// breakerOpen fails every request until CoolDown has passed
+	breakerOpen
+	// breakerHalfOpen lets one trial request through, which closes the
+	// breaker if it succeeds and opens it again if not
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is the circuit breaker of a single peer.
+type breaker struct {
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	slow        int
+	openedAt    time.Time
+	trial       bool // a half-open trial request is in flight
+	// gen changes with every change of state. allow hands it out with each
+	// request, so that done can ignore requests let through before it.
+	gen uint64
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	def := DefaultBreakerConfig
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = def.MinRequests
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = def.ErrorRate
+	}
+	if cfg.SlowCall <= 0 {
+		cfg.SlowCall = def.SlowCall
+	}
+	if cfg.SlowRate <= 0 {
+		cfg.SlowRate = def.SlowRate
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = def.CoolDown
+	}
+	return &breaker{cfg: cfg}
+}
+
+// allow reports whether a request may be sent now, and the generation it
+// was let through in. Every allowed request must be followed by done or
+// cancel with that generation.
+func (b *breaker) allow(now time.Time) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cfg.CoolDown {
+			return 0, false
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return b.gen, true
+	case breakerHalfOpen:
+		// 半开状态下同一时间只放一个试探请求过去
+		if b.trial {
+			return 0, false
+		}
+		b.trial = true
+		return b.gen, true
+	default:
+		return b.gen, true
+	}
+}
+
+// done records whether a request allow let through in generation gen
+// failed, and how long it took. Requests let through before the breaker
+// last changed state say nothing about the current one and are ignored.
+func (b *breaker) done(now time.Time, gen uint64, failed bool, took time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.gen {
+		return
+	}
+	slow := took > b.cfg.SlowCall
+	if b.state == breakerHalfOpen {
+		b.trial = false
+		if failed || slow {
+			b.open(now)
+		} else {
+			b.setState(breakerClosed)
+			b.reset(now)
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	if now.Sub(b.windowStart) > b.cfg.Window {
+		b.reset(now)
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+	if b.requests < b.cfg.MinRequests {
+		return
+	}
+	if float64(b.failures) >= b.cfg.ErrorRate*float64(b.requests) ||
+		float64(b.slow) >= b.cfg.SlowRate*float64(b.requests) {
+		b.open(now)
+	}
+}
+
+// cancel ends a request of generation gen whose caller gave up on it, so
+// its outcome tells nothing about the peer. A half-open breaker lets the
+// next request through as the trial instead.
+func (b *breaker) cancel(gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen == b.gen && b.state == breakerHalfOpen {
+		b.trial = false
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.setState(breakerOpen)
+	b.openedAt = now
+}
+
+func (b *breaker) setState(s breakerState) {
+	b.state = s
+	b.gen++
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.windowStart = now
+	b.requests, b.failures, b.slow = 0, 0, 0
+}
+
+// current returns the breaker's state as a request sent now would see it.
+func (b *breaker) current(now time.Time) breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.cfg.CoolDown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// peerFailed reports whether err, returned by a request the caller did
+// not cancel, says the peer itself is in trouble rather than the request.
+func peerFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pe *PeerError
+	if !errors.As(err, &pe) {
+		// 连接失败、超时等传输层错误
+		return true
+	}
+	switch pe.Status {
+	case pb.Status_INTERNAL, pb.Status_TIMEOUT, pb.Status_OVERLOADED:
+		return true
+	default:
+		return false
+	}
+}
+
+// guard runs req through the breaker b, which may be nil, failing fast
+// with ErrCircuitOpen while it is open.
+func (b *breaker) guard(ctx context.Context, req func() error) error {
+	if b == nil {
+		return req()
+	}
+	gen, ok := b.allow(time.Now())
+	if !ok {
+		return ErrCircuitOpen
+	}
+	start := time.Now()
+	err := req()
+	// 调用方自己取消的请求既不算 peer 的失败，也不算成功
+	if ctx.Err() != nil {
+		b.cancel(gen)
+		return err
+	}
+	b.done(time.Now(), gen, peerFailed(err), time.Since(start))
+	return err
+}
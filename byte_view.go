@@ -1,8 +1,14 @@
 package GoDistributedCache
 
+import (
+	"encoding/binary"
+	"time"
+)
+
 // A ByteView holds an immutable view of bytes. It is safe for concurrent access.
 type ByteView struct {
 	b []byte
+	e time.Time // zero if the value never expires
 }
 
 // Len returns the view's length
@@ -20,8 +26,47 @@ func (v ByteView) String() string {
 	return string(v.b)
 }
 
+// Expire returns the time the view goes stale, or the zero time if it never does.
+func (v ByteView) Expire() time.Time {
+	return v.e
+}
+
+func (v ByteView) expired(now time.Time) bool {
+	return !v.e.IsZero() && !now.Before(v.e)
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
 	return c
 }
+
+// expireToNano and expireFromNano convert an expiry to and from the
+// pb.Response wire form, where 0 means no expiry.
+func expireToNano(e time.Time) int64 {
+	if e.IsZero() {
+		return 0
+	}
+	return e.UnixNano()
+}
+
+func expireFromNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// marshalWithExpiry encodes v for the byte-oriented stores, the expiry in
+// the 8 bytes in front of the value.
+func (v ByteView) marshalWithExpiry() []byte {
+	b := make([]byte, 8+len(v.b))
+	binary.LittleEndian.PutUint64(b, uint64(expireToNano(v.e)))
+	copy(b[8:], v.b)
+	return b
+}
+
+// unmarshalWithExpiry decodes what marshalWithExpiry encoded, keeping b.
+func unmarshalWithExpiry(b []byte) ByteView {
+	return ByteView{b: b[8:], e: expireFromNano(int64(binary.LittleEndian.Uint64(b)))}
+}
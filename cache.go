@@ -2,33 +2,270 @@ package GoDistributedCache
 
 import (
 	"GoDistributedCache/obsolescence"
+	"container/heap"
+	"hash/maphash"
 	"sync"
+	"time"
 )
 
+const defaultSweepInterval = time.Minute
+
+// cache spreads its keys over shards that each have their own lock and an
+// equal part of cacheBytes, so concurrent Gets of different keys rarely
+// wait on each other. policy, cacheBytes, nshards and sweepInterval are
+// configured before first use and never change afterwards.
 type cache struct {
+	policy        obsolescence.Policy // nil means obsolescence.LRU
+	cacheBytes    int64
+	nshards       int // 0 means 1
+	sweepInterval time.Duration
+	// evicted, if set, is called with the shard's lock held for every
+	// entry the policy evicts, not for removed or expired ones. It must not
+	// block, as every Get on the shard waits for it.
+	evicted func(key string, value ByteView)
+
+	initOnce  sync.Once
+	seed      maphash.Seed
+	shards    []*cacheShard
+	sweepOnce sync.Once
+}
+
+type cacheShard struct {
+	c          *cache
 	mu         sync.Mutex
-	lru        *obsolescence.LRUCache
-	cacheBytes int64
+	lru        obsolescence.Cache
+	nget, nhit int64
+	nevict     int64 // entries dropped by the policy to stay within its bytes
+	// removing is set while the shard deletes an entry itself, so that
+	// onEvicted can tell explicit removals from evictions
+	removing bool
+	// expiries orders the keys added with an expiry so the sweeper can find
+	// them without walking the whole shard. expiring indexes it by key, so
+	// every key has at most one entry and loses it when it leaves the shard.
+	expiries expiryHeap
+	expiring map[string]*expiryEntry
+}
+
+// init creates the shards on first use, splitting cacheBytes between them.
+// A limited cache never gets more shards than bytes, as a shard with a
+// budget of 0 would be unlimited.
+func (c *cache) init() {
+	c.initOnce.Do(func() {
+		n := max(c.nshards, 1)
+		if c.cacheBytes > 0 && int64(n) > c.cacheBytes {
+			n = int(c.cacheBytes)
+		}
+		policy := c.policy
+		if policy == nil {
+			policy = obsolescence.LRU
+		}
+		c.seed = maphash.MakeSeed()
+		c.shards = make([]*cacheShard, n)
+		for i := range c.shards {
+			s := &cacheShard{c: c}
+			s.lru = policy(c.cacheBytes/int64(n), s.onEvicted)
+			c.shards[i] = s
+		}
+	})
+}
+
+func (c *cache) shard(key string) *cacheShard {
+	c.init()
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
 }
 
 func (c *cache) add(key string, value ByteView) {
-	// lazy initialization
-	if c.lru == nil {
-		c.lru = obsolescence.NewLRUCache(c.cacheBytes, nil)
+	s := c.shard(key)
+	s.mu.Lock()
+	// 先记下过期时间，Add 如果立刻把它淘汰掉，onEvicted 会再删掉
+	s.setExpiry(key, value.e)
+	s.lru.Add(key, value)
+	s.mu.Unlock()
+	if !value.e.IsZero() {
+		c.sweepOnce.Do(func() { go c.sweep() })
 	}
-	c.mu.Lock()
-	c.lru.Add(key, value)
-	c.mu.Unlock()
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
-	if c.lru == nil {
-		return
-	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if v, ok := c.lru.Get(key); ok {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nget++
+	if v, ok := s.lru.Get(key); ok {
+		// 过期的值在读取时顺便删除
+		if v.(ByteView).expired(time.Now()) {
+			s.del(key)
+			return ByteView{}, false
+		}
+		s.nhit++
 		return v.(ByteView), ok
 	}
 	return
 }
+
+// peek is get for the cache's own bookkeeping, e.g. hot key replication,
+// which is not counted in the Gets and hits of stats. The eviction policy
+// still sees it as a use of the key.
+func (c *cache) peek(key string) (value ByteView, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.lru.Get(key); ok && !v.(ByteView).expired(time.Now()) {
+		return v.(ByteView), true
+	}
+	return
+}
+
+func (c *cache) remove(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	s.del(key)
+	s.mu.Unlock()
+}
+
+// del deletes key without counting it as an eviction. s.mu must be held.
+func (s *cacheShard) del(key string) {
+	s.removing = true
+	s.lru.Del(key)
+	s.removing = false
+}
+
+// onEvicted is called by the eviction policy with s.mu held.
+func (s *cacheShard) onEvicted(key string, value obsolescence.Value) {
+	s.dropExpiry(key)
+	if s.removing {
+		return
+	}
+	s.nevict++
+	if s.c.evicted != nil {
+		s.c.evicted(key, value.(ByteView))
+	}
+}
+
+func (c *cache) stats() CacheStats {
+	c.init()
+	st := CacheStats{MaxBytes: c.cacheBytes}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Gets += s.nget
+		st.Hits += s.nhit
+		st.Evictions += s.nevict
+		st.Bytes += s.lru.Bytes()
+		st.Items += int64(s.lru.Len())
+		s.mu.Unlock()
+	}
+	return st
+}
+
+// walkShards calls fn with each shard's entries, oldest first, collected
+// while its lock is held so that fn itself does not block the shard.
+func (c *cache) walkShards(fn func(keys []string, values []ByteView) error) error {
+	c.init()
+	for _, s := range c.shards {
+		var keys []string
+		var values []ByteView
+		s.mu.Lock()
+		s.lru.Walk(func(key string, value obsolescence.Value) {
+			keys = append(keys, key)
+			values = append(values, value.(ByteView))
+		})
+		s.mu.Unlock()
+		if err := fn(keys, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExpired deletes every entry that has expired by now.
+func (c *cache) removeExpired(now time.Time) {
+	c.init()
+	for _, s := range c.shards {
+		s.removeExpired(now)
+	}
+}
+
+func (s *cacheShard) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.expiries) > 0 && !now.Before(s.expiries[0].e) {
+		key := s.expiries[0].key
+		s.dropExpiry(key)
+		s.del(key)
+	}
+}
+
+// setExpiry records that key, being added with expiry e, expires then,
+// replacing the expiry of the value it overwrites. s.mu must be held.
+func (s *cacheShard) setExpiry(key string, e time.Time) {
+	ent, ok := s.expiring[key]
+	switch {
+	case e.IsZero():
+		s.dropExpiry(key)
+	case ok:
+		ent.e = e
+		heap.Fix(&s.expiries, ent.index)
+	default:
+		if s.expiring == nil {
+			s.expiring = make(map[string]*expiryEntry)
+		}
+		ent = &expiryEntry{key: key, e: e}
+		heap.Push(&s.expiries, ent)
+		s.expiring[key] = ent
+	}
+}
+
+// dropExpiry forgets the expiry of key. s.mu must be held.
+func (s *cacheShard) dropExpiry(key string) {
+	if ent, ok := s.expiring[key]; ok {
+		heap.Remove(&s.expiries, ent.index)
+		delete(s.expiring, key)
+	}
+}
+
+// sweep periodically drops expired entries that nobody reads anymore, so
+// they don't hold on to cacheBytes until eviction pushes them out.
+func (c *cache) sweep() {
+	interval := c.sweepInterval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.removeExpired(now)
+	}
+}
+
+type expiryEntry struct {
+	key   string
+	e     time.Time
+	index int // in expiryHeap
+}
+
+// expiryHeap is a min-heap of expiryEntry ordered by expiry.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].e.Before(h[j].e) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *expiryHeap) Push(x interface{}) {
+	ent := x.(*expiryEntry)
+	ent.index = len(*h)
+	*h = append(*h, ent)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
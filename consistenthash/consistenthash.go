@@ -15,6 +15,7 @@ type HashNodes struct {
 	replicas       int            // Number of virtual nodes
 	keys           []int          // Sorted
 	virtualNodeMap map[int]string // virtual node and actual node
+	nodes          map[string]bool
 }
 
 // NewHashNodes creates a HashNodes instance
@@ -23,6 +24,7 @@ func NewHashNodes(replicas int, fn HashF) *HashNodes {
 		replicas:       replicas,
 		hash:           fn,
 		virtualNodeMap: make(map[int]string),
+		nodes:          make(map[string]bool),
 	}
 	if m.hash == nil {
 		m.hash = crc32.ChecksumIEEE
@@ -34,6 +36,7 @@ func NewHashNodes(replicas int, fn HashF) *HashNodes {
 func (m *HashNodes) Add(nodes ...string) {
 	// 为了解决倾斜的问题，引入虚拟节点，虚拟节点的个数是replicas，用这样多个节点再哈希，然后再映射到真实的节点
 	for _, node := range nodes {
+		m.nodes[node] = true
 		for i := 0; i < m.replicas; i++ {
 			hash := int(m.hash([]byte(strconv.Itoa(i) + node)))
 			m.keys = append(m.keys, hash)
@@ -43,6 +46,16 @@ func (m *HashNodes) Add(nodes ...string) {
 	sort.Ints(m.keys)
 }
 
+// Len returns the number of virtual nodes on the ring.
+func (m *HashNodes) Len() int {
+	return len(m.keys)
+}
+
+// Nodes returns the number of actual nodes on the ring.
+func (m *HashNodes) Nodes() int {
+	return len(m.nodes)
+}
+
 // Get gets the closest item in the hash to the provided key.
 func (m *HashNodes) Get(key string) string {
 	// 先做hash值，然后在环上找到最近的一个节点，再考虑环的问题，然后用Map映射到真实的节点
@@ -56,3 +69,27 @@ func (m *HashNodes) Get(key string) string {
 	// 所以只要加了一个%操作，就是一个环了
 	return m.virtualNodeMap[m.keys[idx%len(m.keys)]]
 }
+
+// GetN returns up to n distinct nodes for key: the one Get returns,
+// followed by the next nodes clockwise on the ring, which are where the
+// key moves if the nodes before them are removed.
+func (m *HashNodes) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	// 沿着环往后走，跳过属于已选节点的虚拟节点
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.virtualNodeMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -2,6 +2,7 @@ package consistenthash
 
 import (
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -41,3 +42,45 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestGetN(t *testing.T) {
+	hash := NewHashNodes(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("6", "4", "2")
+
+	testCases := []struct {
+		key  string
+		n    int
+		want []string
+	}{
+		{"11", 2, []string{"2", "4"}},
+		{"23", 3, []string{"4", "6", "2"}},
+		{"27", 5, []string{"2", "4", "6"}}, // only 3 nodes on the ring
+		{"5", 1, []string{"6"}},
+	}
+	for _, tc := range testCases {
+		got := hash.GetN(tc.key, tc.n)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("GetN(%s, %d) = %v, want %v", tc.key, tc.n, got, tc.want)
+		}
+		if got[0] != hash.Get(tc.key) {
+			t.Errorf("GetN(%s) starts with %s, Get returns %s", tc.key, got[0], hash.Get(tc.key))
+		}
+	}
+}
+
+func TestNodes(t *testing.T) {
+	hash := NewHashNodes(3, nil)
+	if hash.Nodes() != 0 {
+		t.Errorf("Nodes() = %d on an empty ring, want 0", hash.Nodes())
+	}
+	hash.Add("6", "4", "2")
+	// adding a node twice does not count it twice
+	hash.Add("8", "2")
+	if hash.Nodes() != 4 {
+		t.Errorf("Nodes() = %d, want 4", hash.Nodes())
+	}
+}
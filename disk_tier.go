@@ -0,0 +1,145 @@
+package GoDistributedCache
+
+import (
+	"GoDistributedCache/diskcache"
+	"log"
+	"maps"
+	"sync"
+)
+
+// maxPendingSpills bounds the evicted entries waiting to be written to disk.
+// Entries evicted while that many are waiting are dropped, like they would
+// be without a disk tier.
+const maxPendingSpills = 4096
+
+// diskTier is the disk tier of a Group. Evictions run with a shard's lock
+// held and deletes on the Get, Set and Remove paths, so put and del only
+// queue the change and a background writer makes it on disk, in order,
+// keeping disk I/O and compactions off those paths.
+type diskTier struct {
+	store *diskcache.Store
+
+	mu      sync.Mutex
+	pending map[string]*diskOp // not yet on disk
+	wake    chan struct{}
+	start   sync.Once
+}
+
+// diskOp is a queued change to the disk copy of a key.
+type diskOp struct {
+	value ByteView
+	del   bool
+}
+
+func newDiskTier(store *diskcache.Store) *diskTier {
+	return &diskTier{
+		store:   store,
+		pending: make(map[string]*diskOp),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// get returns the value of key, pending or on disk.
+func (d *diskTier) get(key string) (ByteView, error) {
+	d.mu.Lock()
+	op, ok := d.pending[key]
+	d.mu.Unlock()
+	if ok {
+		if op.del {
+			return ByteView{}, diskcache.ErrNotFound
+		}
+		return op.value, nil
+	}
+	b, err := d.store.Get(key)
+	if err != nil {
+		return ByteView{}, err
+	}
+	return unmarshalWithExpiry(b), nil
+}
+
+// put queues value to be written for key.
+func (d *diskTier) put(key string, value ByteView) {
+	d.mu.Lock()
+	if _, ok := d.pending[key]; !ok && len(d.pending) >= maxPendingSpills {
+		d.mu.Unlock()
+		return
+	}
+	d.pending[key] = &diskOp{value: value}
+	d.mu.Unlock()
+	d.notify()
+}
+
+// del queues key to be deleted. Deletes are never dropped, a key left on
+// disk would come back with its old value, but only keys that are pending
+// or on disk are queued.
+func (d *diskTier) del(key string) {
+	d.mu.Lock()
+	if _, ok := d.pending[key]; ok {
+		d.pending[key] = &diskOp{del: true}
+		d.mu.Unlock()
+		d.notify()
+		return
+	}
+	d.mu.Unlock()
+	// 不在队列里的 key 只可能已经写完，Has 只查内存索引
+	if !d.store.Has(key) {
+		return
+	}
+	d.mu.Lock()
+	// 期间又被淘汰了一次，那个值比这次删除更新
+	if _, ok := d.pending[key]; !ok {
+		d.pending[key] = &diskOp{del: true}
+	}
+	d.mu.Unlock()
+	d.notify()
+}
+
+func (d *diskTier) notify() {
+	d.start.Do(func() { go d.run() })
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *diskTier) run() {
+	for range d.wake {
+		d.flush()
+	}
+}
+
+// flush makes every pending change on disk. Changes stay pending, and so
+// visible to get, until they are.
+func (d *diskTier) flush() {
+	d.mu.Lock()
+	batch := maps.Clone(d.pending)
+	d.mu.Unlock()
+	for key, op := range batch {
+		d.write(key, op)
+	}
+}
+
+// write makes op on disk, unless a later change to key replaced it in the
+// queue. Only the background writer, or a test flushing itself, calls it.
+func (d *diskTier) write(key string, op *diskOp) {
+	d.mu.Lock()
+	current := d.pending[key] == op
+	d.mu.Unlock()
+	if !current {
+		return
+	}
+	var err error
+	if op.del {
+		err = d.store.Del(key)
+	} else {
+		err = d.store.Put(key, op.value.marshalWithExpiry())
+	}
+	if err != nil {
+		log.Println("[GoDistributedCache] Failed to write to disk", err)
+	}
+	d.mu.Lock()
+	if d.pending[key] == op {
+		delete(d.pending, key)
+	}
+	d.mu.Unlock()
+}
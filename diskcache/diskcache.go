@@ -0,0 +1,321 @@
+package diskcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// headerSize is the size of the header in front of every record: the
+// CRC-32 of the rest of the record, the key length and the value length.
+const headerSize = 4 + 4 + 4
+
+// tombstone is the value length of a record that deletes its key.
+const tombstone = 1<<32 - 1
+
+// ErrNotFound is returned by Get for a key the store does not hold.
+var ErrNotFound = errors.New("diskcache: not found")
+
+// Store is a bitcask-style key-value store. Every Put and Del appends a
+// record to a single log file and an in-memory index maps each key to its
+// latest record, so a Get is one read. Once the log grows past maxBytes it
+// is compacted into a new file holding only the newest live records, which
+// also evicts the oldest ones; the Put or Del that crossed maxBytes does
+// the compaction, without blocking other callers for most of it. The index is rebuilt from the log on Open.
+// It is safe for concurrent access.
+type Store struct {
+	mu       sync.RWMutex
+	path     string
+	f        *os.File
+	size     int64             // of the log file
+	index    map[string]record // latest record of every live key
+	maxBytes int64
+	// compacting is set while a compaction runs, compactCopied is called
+	// by it once the live records are copied, for tests
+	compacting    bool
+	compactCopied func()
+}
+
+type record struct {
+	off  int64
+	size int64
+}
+
+// Open opens the log at path, creating it if needed, and rebuilds the index
+// from it. A torn record at the end, left by a crash, is cut off.
+func Open(path string, maxBytes int64) (*Store, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("diskcache: maxBytes must be positive, got %d", maxBytes)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, f: f, index: make(map[string]record), maxBytes: maxBytes}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the log into the index.
+func (s *Store) load() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	var off int64
+	for {
+		key, valLen, size, err := s.readRecord(off, fi.Size())
+		if err != nil {
+			// the log ends at the last good record
+			if err := s.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		delete(s.index, key)
+		if valLen != tombstone {
+			s.index[key] = record{off: off, size: size}
+		}
+		off += size
+	}
+	s.size = off
+	return nil
+}
+
+// readRecord reads the key of the record at off, which must end before
+// end, and checks its CRC.
+func (s *Store) readRecord(off, end int64) (key string, valLen uint32, size int64, err error) {
+	var h [headerSize]byte
+	if _, err = s.f.ReadAt(h[:], off); err != nil {
+		return
+	}
+	keyLen := binary.LittleEndian.Uint32(h[4:])
+	valLen = binary.LittleEndian.Uint32(h[8:])
+	n := int64(keyLen)
+	if valLen != tombstone {
+		n += int64(valLen)
+	}
+	if off+headerSize+n > end {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, n)
+	if _, err = s.f.ReadAt(body, off+headerSize); err != nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(h[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.LittleEndian.Uint32(h[:]) {
+		return "", 0, 0, fmt.Errorf("diskcache: corrupt record at %d", off)
+	}
+	return string(body[:keyLen]), valLen, headerSize + n, nil
+}
+
+func encodeRecord(key string, value []byte, valLen uint32) []byte {
+	b := make([]byte, headerSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[8:], valLen)
+	copy(b[headerSize:], key)
+	copy(b[headerSize+len(key):], value)
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// Get returns the value of key.
+func (s *Store) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	b := make([]byte, rec.size)
+	if _, err := s.f.ReadAt(b, rec.off); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b[4:]) != binary.LittleEndian.Uint32(b) {
+		return nil, fmt.Errorf("diskcache: corrupt record at %d", rec.off)
+	}
+	return b[headerSize+len(key):], nil
+}
+
+// Put stores value for key, compacting the log if it grew past maxBytes.
+func (s *Store) Put(key string, value []byte) error {
+	s.mu.Lock()
+	b := encodeRecord(key, value, uint32(len(value)))
+	if _, err := s.f.Write(b); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.index[key] = record{off: s.size, size: int64(len(b))}
+	s.size += int64(len(b))
+	compact := s.startCompaction()
+	s.mu.Unlock()
+	if compact {
+		return s.compact()
+	}
+	return nil
+}
+
+// Del deletes key by appending a tombstone, so that it stays deleted when
+// the index is rebuilt.
+func (s *Store) Del(key string) error {
+	s.mu.Lock()
+	if _, ok := s.index[key]; !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	b := encodeRecord(key, nil, tombstone)
+	if _, err := s.f.Write(b); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.index, key)
+	s.size += int64(len(b))
+	compact := s.startCompaction()
+	s.mu.Unlock()
+	if compact {
+		return s.compact()
+	}
+	return nil
+}
+
+// Has reports whether the store holds key, without reading the log.
+func (s *Store) Has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.index[key]
+	return ok
+}
+
+// startCompaction reports whether the log grew past maxBytes and no
+// compaction is running yet, marking one as running if so. s.mu must be
+// held.
+func (s *Store) startCompaction() bool {
+	if s.size <= s.maxBytes || s.compacting {
+		return false
+	}
+	s.compacting = true
+	return true
+}
+
+// compact rewrites the newest live records, up to three quarters of
+// maxBytes so that the next compaction is some way off, into a new log
+// that replaces the current one. The records are copied without holding
+// s.mu, so Gets, Puts and Dels go on meanwhile; the records written during
+// the copy are then replayed into the new log before it replaces the
+// current one. startCompaction must have returned true.
+func (s *Store) compact() error {
+	defer func() {
+		s.mu.Lock()
+		s.compacting = false
+		s.mu.Unlock()
+	}()
+
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	// newest first
+	sort.Slice(keys, func(i, j int) bool { return s.index[keys[i]].off > s.index[keys[j]].off })
+	var kept int64
+	for i, key := range keys {
+		if kept+s.index[key].size > s.maxBytes*3/4 {
+			keys = keys[:i]
+			break
+		}
+		kept += s.index[key].size
+	}
+	recs := make([]record, len(keys))
+	for i, key := range keys {
+		recs[i] = s.index[key]
+	}
+	src, end := s.f, s.size
+	s.mu.RUnlock()
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]record, len(keys))
+	var off int64
+	for i := len(keys) - 1; i >= 0; i-- {
+		if _, err = io.Copy(tmp, io.NewSectionReader(src, recs[i].off, recs[i].size)); err != nil {
+			break
+		}
+		index[keys[i]] = record{off: off, size: recs[i].size}
+		off += recs[i].size
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if s.compactCopied != nil {
+		s.compactCopied()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 复制期间写入的记录（包括删除）按原来的顺序追加到新文件
+	for pos := end; pos < s.size && err == nil; {
+		var key string
+		var valLen uint32
+		var size int64
+		if key, valLen, size, err = s.readRecord(pos, s.size); err != nil {
+			break
+		}
+		if _, err = io.Copy(tmp, io.NewSectionReader(s.f, pos, size)); err != nil {
+			break
+		}
+		delete(index, key)
+		if valLen != tombstone {
+			index[key] = record{off: off, size: size}
+		}
+		off += size
+		pos += size
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	s.f.Close()
+	s.f, s.index, s.size = tmp, index, off
+	return nil
+}
+
+// Len returns the number of keys in the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.index)
+}
+
+// Size returns the size of the log file.
+func (s *Store) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Close closes the log file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
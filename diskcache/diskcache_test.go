@@ -0,0 +1,133 @@
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	s, err := Open(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("Tom", []byte("630"))
+	s.Put("Jack", []byte("589"))
+	s.Put("Tom", []byte("700"))
+	s.Del("Jack")
+	if v, err := s.Get("Tom"); err != nil || string(v) != "700" {
+		t.Fatalf("Get(Tom) = %q, %v, want 700", v, err)
+	}
+	if _, err := s.Get("Jack"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(Jack) = %v, want ErrNotFound", err)
+	}
+	s.Close()
+
+	// the index is rebuilt from the log, tombstones included
+	if s, err = Open(path, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("Tom"); err != nil || string(v) != "700" {
+		t.Fatalf("reopened Get(Tom) = %q, %v, want 700", v, err)
+	}
+	if _, err := s.Get("Jack"); !errors.Is(err, ErrNotFound) || s.Len() != 1 {
+		t.Fatalf("reopened Get(Jack) = %v, Len() = %d", err, s.Len())
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	s, _ := Open(path, 1<<20)
+	s.Put("Tom", []byte("630"))
+	s.Put("Jack", []byte("589"))
+	size := s.Size()
+	s.Close()
+	// a crash in the middle of the second record
+	os.Truncate(path, size-2)
+
+	s, err := Open(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get("Jack"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("torn record was kept: %v", err)
+	}
+	if v, err := s.Get("Tom"); err != nil || string(v) != "630" {
+		t.Fatalf("Get(Tom) = %q, %v, want 630", v, err)
+	}
+	s.Put("Sam", []byte("567"))
+	if v, err := s.Get("Sam"); err != nil || string(v) != "567" {
+		t.Fatalf("Get(Sam) after the cut = %q, %v", v, err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	const recordSize = headerSize + 4 + 12
+	s, err := Open(path, 10*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 25; i++ {
+		if err := s.Put(fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("value-%06d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if s.Size() > 10*recordSize {
+			t.Fatalf("log grew to %d bytes", s.Size())
+		}
+	}
+	// the newest records survive compaction, the oldest are evicted
+	if v, err := s.Get("k024"); err != nil || string(v) != "value-000024" {
+		t.Fatalf("Get(k024) = %q, %v", v, err)
+	}
+	if _, err := s.Get("k000"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("k000 survived compaction")
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("compaction left its temporary file: %v", err)
+	}
+}
+
+func TestCompactionKeepsConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	const recordSize = headerSize + 4 + 12
+	s, err := Open(path, 10*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// writes made while the live records are being copied
+	s.compactCopied = func() {
+		s.compactCopied = nil
+		s.Put("late", []byte("value-late"))
+		s.Del("k009")
+	}
+	for i := 0; i < 11; i++ {
+		s.Put(fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("value-%06d", i)))
+	}
+	if s.compactCopied != nil {
+		t.Fatalf("log was not compacted")
+	}
+	if v, err := s.Get("late"); err != nil || string(v) != "value-late" {
+		t.Fatalf("Get(late) = %q, %v, want the value Put during compaction", v, err)
+	}
+	if _, err := s.Get("k009"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("k009 deleted during compaction came back: %v", err)
+	}
+	s.Close()
+
+	// the replayed records are in the new log, not only in the index
+	if s, err = Open(path, 10*recordSize); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Has("late") || s.Has("k009") || !s.Has("k010") {
+		t.Fatalf("reopened log lost the writes made during compaction")
+	}
+}
@@ -0,0 +1,172 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	// ErrNoSuchGroup is returned, wrapped, by peers that have no Group of
+	// the requested name.
+	ErrNoSuchGroup = errors.New("no such group")
+	// ErrOverloaded can be wrapped by a Getter that sheds load, e.g. when
+	// its database pool is exhausted. Peers then answer with OVERLOADED
+	// and callers load the key themselves instead of retrying here.
+	ErrOverloaded = errors.New("overloaded")
+)
+
+// A PeerError is an error a peer reported for a request, rebuilt from the
+// Status it sent. It matches the sentinel errors with errors.Is, e.g. a
+// TIMEOUT matches context.DeadlineExceeded.
+type PeerError struct {
+	Status pb.Status
+	Msg    string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer returned %v: %s", e.Status, e.Msg)
+}
+
+func (e *PeerError) Unwrap() error {
+	switch e.Status {
+	case pb.Status_NOT_FOUND:
+		return ErrNotFound
+	case pb.Status_NO_SUCH_GROUP:
+		return ErrNoSuchGroup
+	case pb.Status_TIMEOUT:
+		return context.DeadlineExceeded
+	case pb.Status_OVERLOADED:
+		return ErrOverloaded
+	default:
+		return nil
+	}
+}
+
+// statusOf returns the Status a peer is told for err.
+func statusOf(err error) pb.Status {
+	var pe *PeerError
+	switch {
+	case err == nil:
+		return pb.Status_OK
+	case errors.Is(err, ErrNotFound):
+		return pb.Status_NOT_FOUND
+	case errors.Is(err, ErrNoSuchGroup):
+		return pb.Status_NO_SUCH_GROUP
+	case errors.Is(err, ErrOverloaded):
+		return pb.Status_OVERLOADED
+	case errors.Is(err, errUnauthenticated):
+		return pb.Status_UNAUTHENTICATED
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return pb.Status_TIMEOUT
+	case errors.As(err, &pe):
+		return pe.Status
+	default:
+		return pb.Status_INTERNAL
+	}
+}
+
+// fallBackLocally reports whether a key a peer failed to load with err is
+// worth loading with the local Getter instead. NOT_FOUND is the owner's
+// final answer, and a TIMEOUT means the owner's own load was too slow, so
+// a second load of the same key would only add to the slow backend.
+func fallBackLocally(err error) bool {
+	var pe *PeerError
+	if errors.As(err, &pe) {
+		return pe.Status != pb.Status_NOT_FOUND && pe.Status != pb.Status_TIMEOUT
+	}
+	return !errors.Is(err, ErrNotFound)
+}
+
+// transient reports whether a peer request that failed with err may work
+// if sent again: it failed in transport, not because of anything the peer
+// answered or because the circuit breaker held it back.
+func transient(err error) bool {
+	var pe *PeerError
+	return err != nil && !errors.As(err, &pe) && !errors.Is(err, ErrCircuitOpen) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// httpStatus maps a Status to the HTTP status code HTTPPool answers with.
+func httpStatus(s pb.Status) int {
+	switch s {
+	case pb.Status_OK:
+		return http.StatusOK
+	case pb.Status_NOT_FOUND, pb.Status_NO_SUCH_GROUP:
+		return http.StatusNotFound
+	case pb.Status_BAD_REQUEST:
+		return http.StatusBadRequest
+	case pb.Status_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case pb.Status_OVERLOADED:
+		return http.StatusServiceUnavailable
+	case pb.Status_UNAUTHENTICATED:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// statusFromHTTP guesses the Status of an HTTP error response that did not
+// carry one, e.g. from a proxy in front of the peer.
+func statusFromHTTP(code int) pb.Status {
+	switch code {
+	case http.StatusNotFound:
+		return pb.Status_NO_SUCH_GROUP
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return pb.Status_BAD_REQUEST
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return pb.Status_TIMEOUT
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return pb.Status_OVERLOADED
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return pb.Status_UNAUTHENTICATED
+	default:
+		return pb.Status_INTERNAL
+	}
+}
+
+// grpcCode maps a Status to the gRPC code GRPCPool answers with.
+func grpcCode(s pb.Status) codes.Code {
+	switch s {
+	case pb.Status_OK:
+		return codes.OK
+	case pb.Status_NOT_FOUND, pb.Status_NO_SUCH_GROUP:
+		return codes.NotFound
+	case pb.Status_BAD_REQUEST:
+		return codes.InvalidArgument
+	case pb.Status_TIMEOUT:
+		return codes.DeadlineExceeded
+	case pb.Status_OVERLOADED:
+		return codes.ResourceExhausted
+	case pb.Status_UNAUTHENTICATED:
+		return codes.Unauthenticated
+	default:
+		return codes.Internal
+	}
+}
+
+// statusFromGRPC is the inverse of grpcCode. NotFound only ever comes
+// back for a missing group, missing keys are answered with NOT_FOUND.
+func statusFromGRPC(c codes.Code) pb.Status {
+	switch c {
+	case codes.OK:
+		return pb.Status_OK
+	case codes.NotFound:
+		return pb.Status_NO_SUCH_GROUP
+	case codes.InvalidArgument:
+		return pb.Status_BAD_REQUEST
+	case codes.DeadlineExceeded:
+		return pb.Status_TIMEOUT
+	case codes.ResourceExhausted:
+		return pb.Status_OVERLOADED
+	case codes.Unauthenticated:
+		return pb.Status_UNAUTHENTICATED
+	default:
+		return pb.Status_INTERNAL
+	}
+}
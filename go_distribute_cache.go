@@ -1,6 +1,8 @@
 package GoDistributedCache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -8,14 +10,50 @@ import (
 	"time"
 
 	pb "GoDistributedCache/cachepb"
+	"GoDistributedCache/diskcache"
 	"GoDistributedCache/singleflight"
 )
 
+// defaultNegativeTTL is how long a key that was not found is remembered.
+const defaultNegativeTTL = 10 * time.Second
+
+// ErrNotFound is returned, wrapped, for keys that do not exist. A Getter
+// wraps it to tell a missing key from a failed load, e.g.
+// fmt.Errorf("%s: %w", key, ErrNotFound), and the Group then remembers
+// the key as missing for a while instead of asking the Getter again.
+var ErrNotFound = errors.New("not found")
+
+func errNotFound(key string) error {
+	return fmt.Errorf("%s: %w", key, ErrNotFound)
+}
+
 // A Getter loads data for a key.
 type Getter interface {
 	Get(key string) ([]byte, error)
 }
 
+// A TTLGetter is a Getter that also picks how long each loaded value lives.
+// A ttl <= 0 falls back to the Group's WithTTL setting.
+type TTLGetter interface {
+	Getter
+	GetWithTTL(key string) ([]byte, time.Duration, error)
+}
+
+// A ContextGetter is a Getter that can give up on a load when ctx is done.
+// Group.GetContext prefers it over Get when the Getter implements it.
+type ContextGetter interface {
+	Getter
+	GetContext(ctx context.Context, key string) ([]byte, error)
+}
+
+// A ContextTTLGetter is both a ContextGetter and a TTLGetter in one call.
+// Group prefers it over the other two, which on their own lose either the
+// ctx or the ttl when a Getter implements both.
+type ContextTTLGetter interface {
+	Getter
+	GetWithTTLContext(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
 // A GetterFunc implements Getter with a function.
 type GetterFunc func(key string) ([]byte, error)
 
@@ -26,13 +64,34 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 
 // A Group is a cache namespace and associated data loaded spread over
 type Group struct {
-	name      string
-	getter    Getter
+	name   string
+	getter Getter
+	// mainCache holds the keys this node owns, hotCache the copies of
+	// other peers' keys that are requested often enough to be kept here
 	mainCache cache
-	peers     PeerPicker
+	hotCache  cache
+	// negCache remembers keys that were not found, negTTL is how long
+	negCache cache
+	negTTL   time.Duration
+	promoter *promoter
+	hotKeys  *hotKeyReplicator // nil unless WithHotKeyReplication
+	disk     *diskTier         // nil unless WithDiskCache
+	peers    PeerPicker
+	ttl      time.Duration // zero means values never expire
+	replicas int           // nodes holding each key, owner included
+	// snapshotMaxAge is the age past which Restore refuses a snapshot,
+	// zero means any age
+	snapshotMaxAge time.Duration
+	// hedgeDelay is how long a peer may take before a local load races
+	// it, zero means never. peerRetries and retryBackoff are for transport
+	// errors.
+	hedgeDelay   time.Duration
+	peerRetries  int
+	retryBackoff time.Duration
 	// use singleflight.Group to make sure that
 	// each key is only fetched once
 	loader *singleflight.Group
+	stats  groupStats
 }
 
 var (
@@ -42,7 +101,7 @@ var (
 )
 
 // NewGroup create a new instance of Group
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
+func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -51,14 +110,33 @@ func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
 		name:      name,
 		getter:    getter,
 		mainCache: cache{cacheBytes: cacheBytes},
+		hotCache:  cache{cacheBytes: shareOf(cacheBytes, 8)},
+		negCache:  cache{cacheBytes: shareOf(cacheBytes, 16)},
+		negTTL:    defaultNegativeTTL,
+		promoter:  newPromoter(defaultHotKeyThreshold),
 		loader:    &singleflight.Group{},
 	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.hotKeys != nil {
+		go g.hotKeys.run()
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	groups[name] = g
 	return g
 }
 
+// shareOf returns a 1/n share of cacheBytes for a smaller cache. It is
+// never 0, which means unlimited, unless cacheBytes is.
+func shareOf(cacheBytes int64, n int64) int64 {
+	if cacheBytes <= 0 {
+		return cacheBytes
+	}
+	return max(cacheBytes/n, 1)
+}
+
 // GetGroup returns the named group previously created with NewGroup, or
 // nil if there's no such group.
 func GetGroup(name string) *Group {
@@ -75,14 +153,23 @@ func (g *Group) GetPeers() (res string) {
 
 // Get value for a key from cache
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but returns ctx.Err() once ctx is done instead of
+// waiting for a slow peer or Getter. The load itself keeps going for any
+// other caller waiting on the same key.
+func (g *Group) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
-	if v, ok := g.mainCache.get(key); ok {
-		log.Println("[GoDistributedCache] hit")
+	if v, ok := g.lookupCache(key); ok {
 		return v, nil
 	}
-	return g.load(key)
+	if g.knownMissing(key) {
+		return ByteView{}, errNotFound(key)
+	}
+	return g.load(ctx, key)
 }
 
 // RegisterPeers registers a PeerPicker for choosing remote peer
@@ -93,18 +180,71 @@ func (g *Group) RegisterPeers(peers PeerPicker) {
 	g.peers = peers
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
-	view, err := g.loader.Do(key, func() (interface{}, error) {
+func (g *Group) load(ctx context.Context, key string) (value ByteView, err error) {
+	g.stats.loads.Add(1)
+	// 在 singleflight 之前计数，这样并发请求同一个 key 也会让它更快成为热点
+	g.promoter.record(key)
+	// ctx 只决定当前调用方等多久，fn 拿到的是 singleflight 分离出来的 ctx
+	view, err := g.loader.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		g.stats.loadsRun.Add(1)
+		if value, ok := g.getFromDisk(key); ok {
+			g.stats.diskHits.Add(1)
+			return value, nil
+		}
+		owner := true
 		if g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
+				owner = false
+				value, local, err := g.getFromPeer(ctx, peer, key)
+				// 对冲的本地加载先返回了结果，或者是最后一个失败的
+				if local {
+					if err != nil {
+						g.stats.localLoadErrs.Add(1)
+						return nil, err
+					}
+					g.stats.localLoads.Add(1)
 					return value, nil
 				}
-				log.Println("[GeeCache] Failed to get from peer", err)
+				// owner 说 key 不存在就不再回退到本地 Getter
+				if err == nil || errors.Is(err, ErrNotFound) {
+					g.stats.peerLoads.Add(1)
+					return value, err
+				}
+				g.stats.peerErrors.Add(1)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				// owner 熔断时，开启了副本就先问环上后面保存副本的 peer
+				if errors.Is(err, ErrCircuitOpen) {
+					if value, ok, err := g.askReplicas(ctx, peer, key); ok {
+						g.stats.peerLoads.Add(1)
+						return value, err
+					}
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+				}
+				if !fallBackLocally(err) {
+					return nil, err
+				}
+				// 熔断中的 peer 每次都会失败，不必每次都打日志
+				if !errors.Is(err, ErrCircuitOpen) {
+					log.Println("[GeeCache] Failed to get from peer", err)
+				}
 			}
 		}
 
-		return g.getLocally(key)
+		value, err := g.getLocally(ctx, key)
+		if err != nil {
+			g.stats.localLoadErrs.Add(1)
+			return nil, err
+		}
+		g.stats.localLoads.Add(1)
+		// 只有 owner 才把值推给环上后面的 peer 做副本
+		if owner && g.replicas > 1 {
+			go g.replicate(key, value)
+		}
+		return value, nil
 	})
 
 	if err == nil {
@@ -113,36 +253,331 @@ func (g *Group) load(key string) (value ByteView, err error) {
 	return
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+// getFromPeer gets key from peer. With WithHedging, a peer that has not
+// answered within hedgeDelay races a local load, and local reports whether
+// the result is that load's.
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (value ByteView, local bool, err error) {
+	if g.hedgeDelay <= 0 {
+		value, err = g.askPeer(ctx, peer, key)
+		return value, false, err
+	}
+	// 先返回的一方胜出，另一方随 ctx 一起取消
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		value ByteView
+		local bool
+		err   error
+	}
+	results := make(chan result, 2)
+	go func() {
+		v, err := g.askPeer(ctx, peer, key)
+		results <- result{v, false, err}
+	}()
+	hedge := time.NewTimer(g.hedgeDelay)
+	defer hedge.Stop()
+	pending := 1
+	var localFailed *result
+	for {
+		select {
+		case <-hedge.C:
+			g.stats.peerHedges.Add(1)
+			pending++
+			go func() {
+				v, err := g.getLocally(ctx, key)
+				results <- result{v, true, err}
+			}()
+		case r := <-results:
+			pending--
+			switch {
+			case r.err == nil:
+				if r.local {
+					g.stats.hedgeWins.Add(1)
+				}
+				return r.value, r.local, nil
+			case !r.local && errors.Is(r.err, ErrNotFound):
+				// owner 说 key 不存在，这是最终结果
+				return r.value, false, r.err
+			case pending > 0:
+				// 另一路还在跑，等它的结果
+				if r.local {
+					localFailed = &r
+				}
+			case localFailed != nil:
+				// 两路都失败了，返回本地的错误，免得 load 再去本地加载一次
+				return localFailed.value, true, localFailed.err
+			default:
+				return r.value, r.local, r.err
+			}
+		}
+	}
+}
+
+// askPeer gets key from peer, retrying transport errors up to peerRetries
+// times with a jittered, doubling backoff.
+func (g *Group) askPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
 	req := &pb.Request{
 		Group: g.name,
 		Key:   key,
 	}
-	res := &pb.Response{}
-	err := peer.Get(req, res)
-	if err != nil {
-		return ByteView{}, err
+	for retry := 0; ; retry++ {
+		res := &pb.Response{}
+		err := peer.Get(ctx, req, res)
+		if err == nil {
+			return g.peerValue(key, res)
+		}
+		if retry >= g.peerRetries || !transient(err) || ctx.Err() != nil {
+			return ByteView{}, err
+		}
+		g.stats.peerRetries.Add(1)
+		if backoff := g.retryBackoff << retry; backoff > 0 {
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(backoff))) + 1):
+			case <-ctx.Done():
+				return ByteView{}, ctx.Err()
+			}
+		}
+	}
+}
+
+// peerValue turns a peer's response for key into a ByteView, or into
+// ErrNotFound if the peer does not have the key, or into a PeerError if it
+// failed to load it.
+func (g *Group) peerValue(key string, res *pb.Response) (ByteView, error) {
+	switch res.GetStatus() {
+	case pb.Status_OK:
+	case pb.Status_NOT_FOUND:
+		g.populateNegativeCache(key)
+		return ByteView{}, errNotFound(key)
+	default:
+		return ByteView{}, &PeerError{Status: res.GetStatus(), Msg: res.GetError()}
 	}
-	value := ByteView{b: res.Value}
-	// 十分之一的概率缓存到本地，既对热点数据进行缓存，又防止分布式缓存的过度重复存储
-	rand.Seed(time.Now().UnixNano())
-	probability := rand.Float64()
-	if probability < 0.1 {
-		g.populateCache(key, value)
+	// 使用 owner 的过期时间，避免副本比 owner 上的值活得更久
+	value := ByteView{b: res.GetValue(), e: expireFromNano(res.GetExpire())}
+	// 只有最近被频繁请求的 key 才在本地的 hotCache 中保留副本
+	if g.promoter.hot(key) {
+		g.populateHotCache(key, value)
 	}
 	return value, nil
 }
 
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key)
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	var (
+		bytes []byte
+		ttl   time.Duration
+		err   error
+	)
+	if ctg, ok := g.getter.(ContextTTLGetter); ok {
+		bytes, ttl, err = ctg.GetWithTTLContext(ctx, key)
+	} else if cg, ok := g.getter.(ContextGetter); ok {
+		bytes, err = cg.GetContext(ctx, key)
+	} else if tg, ok := g.getter.(TTLGetter); ok {
+		bytes, ttl, err = tg.GetWithTTL(key)
+	} else {
+		bytes, err = g.getter.Get(key)
+	}
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			g.populateNegativeCache(key)
+		}
 		return ByteView{}, err
 	}
-	value := ByteView{b: cloneBytes(bytes)}
+	value := ByteView{b: cloneBytes(bytes), e: g.expireAfter(ttl)}
 	g.populateCache(key, value)
 	return value, nil
 }
 
+// expireAfter returns the expiry of a value loaded now with the given ttl,
+// falling back to the Group's default ttl when it is not positive.
+func (g *Group) expireAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		ttl = g.ttl
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// getFromDisk looks key up in the disk tier, moving it back into the main
+// cache if found. The disk copy stays, it is overwritten if the key is
+// evicted again and dropped by anything that gives the key a new value.
+func (g *Group) getFromDisk(key string) (ByteView, bool) {
+	if g.disk == nil {
+		return ByteView{}, false
+	}
+	value, err := g.disk.get(key)
+	if err != nil {
+		if !errors.Is(err, diskcache.ErrNotFound) {
+			log.Println("[GoDistributedCache] Failed to get from disk", err)
+		}
+		return ByteView{}, false
+	}
+	if value.expired(time.Now()) {
+		g.disk.del(key)
+		return ByteView{}, false
+	}
+	g.populateCache(key, value)
+	return value, true
+}
+
+// dropFromDisk deletes the disk copy of key once the key has a new value,
+// which would otherwise come back from disk when it leaves memory by
+// expiring rather than being evicted.
+func (g *Group) dropFromDisk(key string) {
+	if g.disk == nil {
+		return
+	}
+	g.disk.del(key)
+}
+
+// spillToDisk queues an entry evicted from the main cache for the disk
+// tier. It runs with the shard's lock held, so it must not block.
+func (g *Group) spillToDisk(key string, value ByteView) {
+	if value.expired(time.Now()) {
+		return
+	}
+	g.disk.put(key, value)
+}
+
+// lookupCache looks key up in the main cache, then the hot cache. Their
+// shards count the lookups, which are the Gets and cache hits of Stats.
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, ok := g.mainCache.get(key); ok {
+		return v, true
+	}
+	return g.hotCache.get(key)
+}
+
 func (g *Group) populateCache(key string, value ByteView) {
 	g.mainCache.add(key, value)
 }
+
+func (g *Group) populateHotCache(key string, value ByteView) {
+	g.hotCache.add(key, value)
+}
+
+// populateNegativeCache remembers key as missing for negTTL.
+func (g *Group) populateNegativeCache(key string) {
+	if g.negTTL > 0 {
+		g.negCache.add(key, ByteView{e: time.Now().Add(g.negTTL)})
+	}
+}
+
+func (g *Group) knownMissing(key string) bool {
+	if g.negTTL <= 0 {
+		return false
+	}
+	_, ok := g.negCache.get(key)
+	return ok
+}
+
+// Set stores value for key on the peer that owns it, expiring after the
+// Group's WithTTL setting if there is one. Any hot copy this node kept
+// from an earlier peer load is dropped so the next Get sees the new value.
+func (g *Group) Set(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	expire := g.expireAfter(0)
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			g.removeLocally(key)
+			return peer.Set(context.Background(), &pb.Request{Group: g.name, Key: key, Value: value, Expire: expireToNano(expire)})
+		}
+	}
+	g.setLocally(key, value, expire)
+	return nil
+}
+
+// Remove deletes key from the peer that owns it and from this node.
+func (g *Group) Remove(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	g.removeLocally(key)
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			return peer.Remove(context.Background(), &pb.Request{Group: g.name, Key: key})
+		}
+	}
+	if g.replicas > 1 {
+		go g.dropReplicas(key)
+	}
+	return nil
+}
+
+// Invalidate deletes key from every peer, including the copies non-owners
+// keep after loading it from the owner.
+func (g *Group) Invalidate(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	g.removeLocally(key)
+	if g.peers == nil {
+		return nil
+	}
+	var errs []error
+	for _, peer := range g.peers.AllPeers() {
+		if err := peer.Remove(context.Background(), &pb.Request{Group: g.name, Key: key}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setLocally and removeLocally update this node's cache, they are what a
+// peer runs when the owner-routed Set/Remove arrives over the wire. When
+// this node replicates the key as hot, the copies on peers are pushed again
+// or retracted so they do not keep serving the old value, and with
+// WithReplication setLocally pushes the new value to the key's replicas.
+func (g *Group) setLocally(key string, value []byte, expire time.Time) {
+	g.negCache.remove(key)
+	g.dropFromDisk(key)
+	view := ByteView{b: cloneBytes(value), e: expire}
+	g.populateCache(key, view)
+	if g.hotKeys != nil && g.hotKeys.isHot(key) {
+		go g.hotKeys.push(key)
+	}
+	if g.replicas > 1 {
+		go g.replicate(key, view)
+	}
+}
+
+func (g *Group) removeLocally(key string) {
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+	g.negCache.remove(key)
+	g.dropFromDisk(key)
+	if g.hotKeys != nil && g.hotKeys.forget(key) {
+		go g.hotKeys.retract(key)
+	}
+}
+
+// setFromPeer stores a value a peer sent over the wire: a hot key its owner
+// pushed goes to the hot cache, a replica to the main cache, anything else
+// is a Set routed to this node.
+func (g *Group) setFromPeer(key string, in *pb.Request) {
+	if in.GetHot() {
+		g.negCache.remove(key)
+		g.dropFromDisk(key)
+		g.populateHotCache(key, ByteView{b: cloneBytes(in.GetValue()), e: expireFromNano(in.GetExpire())})
+		return
+	}
+	if in.GetReplica() {
+		// 副本直接放进 mainCache，owner 下线后这个 key 会路由到本节点
+		g.negCache.remove(key)
+		g.dropFromDisk(key)
+		g.populateCache(key, ByteView{b: cloneBytes(in.GetValue()), e: expireFromNano(in.GetExpire())})
+		return
+	}
+	g.setLocally(key, in.GetValue(), expireFromNano(in.GetExpire()))
+}
+
+// servePeer counts a Get that came over the network from a peer.
+func (g *Group) servePeer(key string) {
+	g.stats.serverRequests.Add(1)
+	if g.hotKeys != nil {
+		g.hotKeys.record(key)
+	}
+}
@@ -1,10 +1,18 @@
 package GoDistributedCache
 
 import (
+	pb "GoDistributedCache/cachepb"
+	"GoDistributedCache/diskcache"
+	"GoDistributedCache/obsolescence"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetter(t *testing.T) {
@@ -52,3 +60,1143 @@ func TestGet(t *testing.T) {
 		t.Fatalf("the value of unknow should be empty, but %s got", view)
 	}
 }
+
+// fakePeers routes every key to a single in-memory peer.
+type fakePeers struct {
+	owner  *fakePeer
+	others []*fakePeer
+}
+
+func (p *fakePeers) PickPeer(key string) (PeerGetter, bool) { return p.owner, true }
+
+func (p *fakePeers) GetPeers() string { return "" }
+
+func (p *fakePeers) AllPeers() []PeerGetter {
+	res := []PeerGetter{p.owner}
+	for _, o := range p.others {
+		res = append(res, o)
+	}
+	return res
+}
+
+type fakePeer struct {
+	data    map[string][]byte
+	removed []string
+	hot     []string // keys pushed as hot
+	replica []string // keys pushed as replicas
+	// retracted lists the keys removed from the hot cache only
+	retracted []string
+	gets      int
+	batches   int
+	// notFound makes Get answer missing keys with a NOT_FOUND status, as
+	// real peers do, instead of an error
+	notFound bool
+	fail     error // returned by Get instead of answering, if set
+	// failFirst limits fail to the first failFirst Gets if set
+	failFirst int
+	delay     time.Duration // Get waits this long before answering
+}
+
+func (p *fakePeer) Get(_ context.Context, in *pb.Request, out *pb.Response) error {
+	p.gets++
+	time.Sleep(p.delay)
+	if p.fail != nil && (p.failFirst == 0 || p.gets <= p.failFirst) {
+		return p.fail
+	}
+	v, ok := p.data[in.GetKey()]
+	if !ok && p.notFound {
+		out.Status = pb.Status_NOT_FOUND
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("%s not exist", in.GetKey())
+	}
+	out.Value = v
+	return nil
+}
+
+func (p *fakePeer) Set(_ context.Context, in *pb.Request) error {
+	if in.GetHot() {
+		p.hot = append(p.hot, in.GetKey())
+	}
+	if in.GetReplica() {
+		p.replica = append(p.replica, in.GetKey())
+	}
+	p.data[in.GetKey()] = in.GetValue()
+	return nil
+}
+
+func (p *fakePeer) Remove(_ context.Context, in *pb.Request) error {
+	if in.GetHot() {
+		p.retracted = append(p.retracted, in.GetKey())
+		return nil
+	}
+	delete(p.data, in.GetKey())
+	p.removed = append(p.removed, in.GetKey())
+	return nil
+}
+
+func (p *fakePeer) GetMulti(_ context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	p.batches++
+	out.Values = make(map[string]*pb.Response)
+	for _, key := range in.GetKeys() {
+		if v, ok := p.data[key]; ok {
+			out.Values[key] = &pb.Response{Value: v}
+		}
+	}
+	return nil
+}
+
+func TestSetRemoveLocal(t *testing.T) {
+	g := NewGroup("set-remove-local", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+
+	if err := g.Set("Tom", []byte("700")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get("Tom"); err != nil || view.String() != "700" {
+		t.Fatalf("Get after Set = %q, %v, want 700", view.String(), err)
+	}
+	if err := g.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get("Tom"); err != nil || view.String() != "db-Tom" {
+		t.Fatalf("Get after Remove = %q, %v, want db-Tom", view.String(), err)
+	}
+}
+
+func TestSetRemoveRoutesToOwner(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{}}
+	other := &fakePeer{data: map[string][]byte{}}
+	g := NewGroup("set-remove-peers", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not exist", key)
+		}))
+	g.RegisterPeers(&fakePeers{owner: owner, others: []*fakePeer{other}})
+
+	// a copy left behind by an earlier peer load must not survive Set
+	g.populateHotCache("Tom", ByteView{b: []byte("630")})
+	if err := g.Set("Tom", []byte("700")); err != nil {
+		t.Fatal(err)
+	}
+	if string(owner.data["Tom"]) != "700" {
+		t.Fatalf("owner has %q, want 700", owner.data["Tom"])
+	}
+	if view, err := g.Get("Tom"); err != nil || view.String() != "700" {
+		t.Fatalf("Get after Set = %q, %v, want 700", view.String(), err)
+	}
+
+	if err := g.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := owner.data["Tom"]; ok {
+		t.Fatalf("Remove did not reach the owner")
+	}
+
+	if err := g.Invalidate("Jack"); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.removed) != 1 || other.removed[0] != "Jack" {
+		t.Fatalf("Invalidate did not reach every peer, got %v", other.removed)
+	}
+}
+
+type ttlGetter map[string]time.Duration
+
+func (g ttlGetter) Get(key string) ([]byte, error) {
+	return []byte(key), nil
+}
+
+func (g ttlGetter) GetWithTTL(key string) ([]byte, time.Duration, error) {
+	return []byte(key), g[key], nil
+}
+
+func TestTTL(t *testing.T) {
+	loads := 0
+	g := NewGroup("ttl", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}), WithTTL(20*time.Millisecond))
+
+	view, err := g.Get("Tom")
+	if err != nil || view.Expire().IsZero() {
+		t.Fatalf("Get(Tom) = %v, %v, want a value with an expiry", view.Expire(), err)
+	}
+	g.Get("Tom")
+	if loads != 1 {
+		t.Fatalf("value reloaded before it expired, loads = %d", loads)
+	}
+	time.Sleep(30 * time.Millisecond)
+	g.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("expired value was served from cache, loads = %d", loads)
+	}
+}
+
+func TestTTLGetterOverride(t *testing.T) {
+	g := NewGroup("ttl-override", 2<<10, ttlGetter{"Tom": time.Hour}, WithTTL(time.Minute))
+
+	tom, _ := g.Get("Tom")
+	if d := time.Until(tom.Expire()); d < 59*time.Minute {
+		t.Fatalf("per-key ttl ignored, Tom expires in %v", d)
+	}
+	jack, _ := g.Get("Jack")
+	if d := time.Until(jack.Expire()); d > time.Minute {
+		t.Fatalf("default ttl ignored, Jack expires in %v", d)
+	}
+
+	g.mainCache.removeExpired(time.Now().Add(2 * time.Minute))
+	if _, ok := g.mainCache.get("Jack"); ok {
+		t.Fatalf("sweep kept expired key Jack")
+	}
+	if _, ok := g.mainCache.get("Tom"); !ok {
+		t.Fatalf("sweep removed live key Tom")
+	}
+}
+
+type ctxTTLGetter struct{ ttlGetter }
+
+func (g ctxTTLGetter) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return []byte(key), ctx.Err()
+}
+
+func (g ctxTTLGetter) GetWithTTLContext(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return []byte(key), g.ttlGetter[key], ctx.Err()
+}
+
+func TestContextTTLGetter(t *testing.T) {
+	g := NewGroup("ttl-context", 2<<10, ctxTTLGetter{ttlGetter{"Tom": time.Hour}})
+
+	tom, _ := g.Get("Tom")
+	if d := time.Until(tom.Expire()); d < 59*time.Minute {
+		t.Fatalf("per-key ttl ignored, Tom expires in %v", d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.GetContext(ctx, "Jack"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetContext(canceled) = %v, want context.Canceled", err)
+	}
+}
+
+func TestTinyCacheBoundsOtherCaches(t *testing.T) {
+	g := NewGroup("tiny-cache", 10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	if hot, neg := g.CacheStats(HotCache).MaxBytes, g.negCache.cacheBytes; hot != 1 || neg != 1 {
+		t.Fatalf("hot cache %d and negative cache %d bytes for a 10 byte cache, want 1 each", hot, neg)
+	}
+	unlimited := NewGroup("unlimited-cache", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	if hot := unlimited.CacheStats(HotCache).MaxBytes; hot != 0 {
+		t.Fatalf("hot cache %d bytes for an unlimited cache, want unlimited", hot)
+	}
+}
+
+func TestExpiryHeapBounded(t *testing.T) {
+	c := &cache{cacheBytes: 64}
+	e := time.Now().Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		c.add("Tom", ByteView{b: []byte("630"), e: e.Add(time.Duration(i))})
+	}
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("key%d", i), ByteView{b: []byte("v"), e: e})
+	}
+	c.remove("key99")
+	s := c.shards[0]
+	if len(s.expiries) != s.lru.Len() {
+		t.Fatalf("%d expiries kept for %d entries", len(s.expiries), s.lru.Len())
+	}
+}
+
+type slowGetter struct {
+	release chan struct{}
+}
+
+func (g slowGetter) Get(key string) ([]byte, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+func (g slowGetter) GetContext(ctx context.Context, key string) ([]byte, error) {
+	select {
+	case <-g.release:
+		return []byte(key), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestGetContextDeadline(t *testing.T) {
+	getter := slowGetter{release: make(chan struct{})}
+	g := NewGroup("get-context", 2<<10, getter)
+
+	patient := make(chan error)
+	go func() {
+		_, err := g.Get("Tom")
+		patient <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.GetContext(ctx, "Tom"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetContext = %v, want DeadlineExceeded", err)
+	}
+
+	// the load carries on for the caller that is still waiting
+	close(getter.release)
+	if err := <-patient; err != nil {
+		t.Fatalf("Get = %v, want the value once the getter returns", err)
+	}
+	if _, ok := g.mainCache.get("Tom"); !ok {
+		t.Fatalf("value loaded after the deadline was not cached")
+	}
+}
+
+func TestStats(t *testing.T) {
+	g := NewGroup("stats", int64(len("Tom")+len("630")+len("Jack")+len("589")), GetterFunc(
+		func(key string) ([]byte, error) {
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}))
+
+	g.Get("Tom")
+	g.Get("Tom")
+	g.Get("Jack")
+	g.Get("Sam") // evicts Tom
+	g.Get("unknown")
+
+	want := Stats{Gets: 5, CacheHits: 1, Loads: 4, LoadsRun: 4, LocalLoads: 3, LocalLoadErrs: 1}
+	if got := g.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+	cs := g.CacheStats(MainCache)
+	if cs.Items != 2 || cs.Evictions != 1 || cs.Hits != 1 || cs.Gets != 5 {
+		t.Fatalf("CacheStats() = %+v, want 2 items, 1 eviction, 1 hit in 5 gets", cs)
+	}
+	if want := int64(len("Jack") + len("589") + len("Sam") + len("567")); cs.Bytes != want {
+		t.Fatalf("CacheStats().Bytes = %d, want %d", cs.Bytes, want)
+	}
+
+	g.Remove("Sam")
+	if cs := g.CacheStats(MainCache); cs.Evictions != 1 {
+		t.Fatalf("Remove counted as an eviction, CacheStats() = %+v", cs)
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	// room for two of Tom, Jack and Sam
+	cacheBytes := int64(len("Jack") + len("589") + len("Sam") + len("567"))
+	tests := []struct {
+		name   string
+		policy obsolescence.Policy
+		want   obsolescence.Cache
+		// key expected to survive reading Tom twice, then loading Jack and Sam
+		kept string
+	}{
+		{"lru", obsolescence.LRU, &obsolescence.LRUCache{}, "Sam"},
+		{"lfu", obsolescence.LFU, &obsolescence.LFUCache{}, "Tom"},
+		{"fifo", obsolescence.FIFO, &obsolescence.FIFOCache{}, "Sam"},
+		{"tinylfu", obsolescence.TinyLFU, &obsolescence.TinyLFUCache{}, "Tom"},
+		{"arc", obsolescence.ARC, &obsolescence.ARCCache{}, "Tom"},
+		{"default", nil, &obsolescence.LRUCache{}, "Sam"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loads := 0
+			var opts []GroupOption
+			if tt.policy != nil {
+				opts = append(opts, WithEvictionPolicy(tt.policy))
+			}
+			g := NewGroup("eviction-"+tt.name, cacheBytes, GetterFunc(
+				func(key string) ([]byte, error) {
+					loads++
+					return []byte(db[key]), nil
+				}), opts...)
+
+			g.Get("Tom")
+			g.Get("Tom")
+			if loads != 1 {
+				t.Fatalf("second Get(Tom) was not a cache hit")
+			}
+			if reflect.TypeOf(g.mainCache.shards[0].lru) != reflect.TypeOf(tt.want) {
+				t.Fatalf("cache uses %T, want %T", g.mainCache.shards[0].lru, tt.want)
+			}
+			g.Get("Jack")
+			g.Get("Sam")
+			if _, ok := g.mainCache.get(tt.kept); !ok {
+				t.Fatalf("%s was evicted", tt.kept)
+			}
+			if cs := g.CacheStats(MainCache); cs.Items != 2 || cs.Evictions != 1 {
+				t.Fatalf("CacheStats() = %+v, want 2 items after 1 eviction", cs)
+			}
+		})
+	}
+}
+
+func TestFIFOIgnoresReads(t *testing.T) {
+	cacheBytes := int64(len("Tom") + len("630") + len("Jack") + len("589"))
+	g := NewGroup("fifo-order", cacheBytes, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(db[key]), nil
+		}), WithEvictionPolicy(obsolescence.FIFO))
+
+	g.Get("Tom")
+	g.Get("Jack")
+	g.Get("Tom") // would save Tom under LRU
+	g.Get("Sam")
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("FIFO kept Tom, the first key in")
+	}
+	if _, ok := g.mainCache.get("Jack"); !ok {
+		t.Fatalf("FIFO evicted Jack instead of Tom")
+	}
+}
+
+func TestHotKeyThresholdClamped(t *testing.T) {
+	for _, tt := range []struct {
+		threshold, promotedAt int
+	}{
+		{0, 1},
+		{1, 1},
+		{15, 15},
+		{16, 15}, // the sketch never counts past 15
+		{100, 15},
+	} {
+		p := newPromoter(tt.threshold)
+		for i := 1; i <= tt.promotedAt; i++ {
+			if p.hot("Tom") {
+				t.Fatalf("threshold %d: Tom hot after %d requests, want %d", tt.threshold, i-1, tt.promotedAt)
+			}
+			p.record("Tom")
+		}
+		if !p.hot("Tom") {
+			t.Fatalf("threshold %d: Tom not hot after %d requests", tt.threshold, tt.promotedAt)
+		}
+	}
+}
+
+func TestHotCachePromotion(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{"Tom": []byte("630"), "Jack": []byte("589")}}
+	g := NewGroup("hot-cache", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithHotKeyThreshold(3))
+	g.RegisterPeers(&fakePeers{owner: owner})
+
+	for i := 0; i < 5; i++ {
+		if view, err := g.Get("Tom"); err != nil || view.String() != "630" {
+			t.Fatalf("Get(Tom) = %q, %v, want 630", view.String(), err)
+		}
+	}
+	// the third request makes Tom hot, the ones after it are served locally
+	if owner.gets != 3 {
+		t.Fatalf("owner served %d Gets, want 3", owner.gets)
+	}
+	g.Get("Jack")
+	if _, ok := g.hotCache.get("Jack"); ok {
+		t.Fatalf("Jack was promoted after a single request")
+	}
+
+	hot := g.CacheStats(HotCache)
+	if hot.Items != 1 || hot.Hits != 2 {
+		t.Fatalf("CacheStats(HotCache) = %+v, want 1 item and 2 hits", hot)
+	}
+	if main := g.CacheStats(MainCache); main.Items != 0 {
+		t.Fatalf("CacheStats(MainCache) = %+v, peer values must not go to the main cache", main)
+	}
+
+	g.Remove("Tom")
+	if _, ok := g.hotCache.get("Tom"); ok {
+		t.Fatalf("Remove kept the hot copy of Tom")
+	}
+}
+
+func TestHotKeyReplication(t *testing.T) {
+	g := NewGroup("hot-key-replication", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithHotKeyReplication(time.Hour, 1, 3))
+	g.setLocally("Tom", []byte("630"), time.Time{})
+	g.setLocally("Jack", []byte("589"), time.Time{})
+	other := &fakePeer{data: map[string][]byte{}}
+	g.RegisterPeers(&fakePeers{owner: &fakePeer{data: map[string][]byte{}}, others: []*fakePeer{other}})
+
+	for i := 0; i < 4; i++ {
+		g.servePeer("Tom")
+	}
+	for i := 0; i < 3; i++ {
+		g.servePeer("Jack")
+	}
+	g.servePeer("Sam")
+	g.hotKeys.replicate()
+	// only the top 1 key is pushed, Sam is below minCount anyway
+	if !reflect.DeepEqual(other.hot, []string{"Tom"}) || string(other.data["Tom"]) != "630" {
+		t.Fatalf("pushed %v, want [Tom]", other.hot)
+	}
+	if s := g.CacheStats(MainCache); s.Gets != 0 {
+		t.Fatalf("pushing Tom counted %d Gets of the main cache", s.Gets)
+	}
+
+	// once Tom's requests slide out of the window it is retracted
+	for i := 0; i < hotKeySlots; i++ {
+		g.hotKeys.replicate()
+	}
+	if !reflect.DeepEqual(other.retracted, []string{"Tom"}) || len(other.removed) != 0 {
+		t.Fatalf("retracted %v and removed %v, want only Tom retracted", other.retracted, other.removed)
+	}
+}
+
+// stuckPeer answers nothing until the request's ctx is done.
+type stuckPeer struct{ fakePeer }
+
+func (p *stuckPeer) Set(ctx context.Context, in *pb.Request) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// stuckPeers adds stuck to the peers of fakePeers.
+type stuckPeers struct {
+	fakePeers
+	stuck *stuckPeer
+}
+
+func (p *stuckPeers) AllPeers() []PeerGetter {
+	return []PeerGetter{p.stuck, p.owner}
+}
+
+func TestHotKeyReplicatorSlowPeer(t *testing.T) {
+	g := NewGroup("hot-key-slow-peer", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not exist", key)
+		}))
+	g.setLocally("Tom", []byte("630"), time.Time{})
+	fast := &fakePeer{data: map[string][]byte{}}
+	g.RegisterPeers(&stuckPeers{fakePeers{owner: fast}, &stuckPeer{}})
+	r := newHotKeyReplicator(g, hotKeySlots*20*time.Millisecond, 1, 1)
+
+	r.record("Tom")
+	start := time.Now()
+	r.replicate()
+	// the stuck peer holds the rotation up for one slot at most, and does
+	// not keep Tom from the other peer
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("replicate took %v with a stuck peer", took)
+	}
+	if !reflect.DeepEqual(fast.hot, []string{"Tom"}) {
+		t.Fatalf("pushed %v to the other peer, want [Tom]", fast.hot)
+	}
+}
+
+func TestHotKeyReplicatorDefaults(t *testing.T) {
+	r := newHotKeyReplicator(nil, time.Nanosecond, 0, 0)
+	if r.tick <= 0 || r.topK != defaultHotKeyTopK || r.minCount != 1 {
+		t.Fatalf("tick %v, topK %d, minCount %d, want the defaults", r.tick, r.topK, r.minCount)
+	}
+}
+
+func TestHotKeyDetectorBounded(t *testing.T) {
+	r := newHotKeyReplicator(nil, time.Hour, 2, 50)
+	// a scan over many distinct keys, with two hot keys mixed in
+	for i := 0; i < 10000; i++ {
+		r.record(fmt.Sprintf("scan%d", i))
+		if i%10 == 0 {
+			r.record("Tom")
+		}
+		if i%20 == 0 {
+			r.record("Jack")
+		}
+	}
+	if n := len(r.slots[len(r.slots)-1].counts); n > 2*hotKeyCounters {
+		t.Fatalf("slot counts %d keys, want at most %d", n, 2*hotKeyCounters)
+	}
+	hot, _ := r.rotate()
+	if !reflect.DeepEqual(hot, []string{"Tom", "Jack"}) {
+		t.Fatalf("hot keys = %v, want [Tom Jack]", hot)
+	}
+
+	// scan keys inherit large counts, but none is ever requested minCount
+	// times, so without hot keys nothing is pushed
+	for i := 1; i < hotKeySlots; i++ {
+		r.rotate()
+	}
+	for i := 0; i < 10000; i++ {
+		r.record(fmt.Sprintf("scan%d", i))
+	}
+	if hot, _ := r.rotate(); len(hot) != 0 {
+		t.Fatalf("hot keys = %v, want none", hot)
+	}
+}
+
+func TestShards(t *testing.T) {
+	g := NewGroup("shards", 1<<20, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), WithShards(8))
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		if view, err := g.Get(key); err != nil || view.String() != key {
+			t.Fatalf("Get(%s) = %q, %v", key, view.String(), err)
+		}
+	}
+	if n := len(g.mainCache.shards); n != 8 {
+		t.Fatalf("main cache has %d shards, want 8", n)
+	}
+	for i, s := range g.mainCache.shards {
+		if s.lru.Len() == 0 {
+			t.Fatalf("shard %d holds no keys", i)
+		}
+	}
+	if s := g.CacheStats(MainCache); s.Items != 1000 || s.MaxBytes != 1<<20 {
+		t.Fatalf("CacheStats(MainCache) = %+v, want 1000 items", s)
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			g := NewGroup(fmt.Sprintf("bench-shards-%d", shards), 1<<20, GetterFunc(
+				func(key string) ([]byte, error) {
+					return []byte(key), nil
+				}), WithShards(shards))
+			for _, key := range keys {
+				g.Get(key)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(p *testing.PB) {
+				for i := 0; p.Next(); i++ {
+					g.Get(keys[i%len(keys)])
+				}
+			})
+		})
+	}
+}
+
+func TestRingStorage(t *testing.T) {
+	g := NewGroup("ring-storage", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}), WithRingStorage(), WithTTL(time.Minute))
+	if view, err := g.Get("Tom"); err != nil || view.String() != "db-Tom" {
+		t.Fatalf("Get(Tom) = %q, %v", view.String(), err)
+	}
+	view, ok := g.mainCache.get("Tom")
+	if !ok || view.String() != "db-Tom" || view.Expire().IsZero() {
+		t.Fatalf("cached Tom = %q expiring %v", view.String(), view.Expire())
+	}
+	g.mainCache.removeExpired(time.Now().Add(2 * time.Minute))
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("expired Tom was kept")
+	}
+	if s := g.CacheStats(MainCache); s.Items != 0 || s.Bytes != 0 || s.Evictions != 0 {
+		t.Fatalf("CacheStats(MainCache) = %+v after expiry", s)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("db-" + key), nil
+	})
+	g := NewGroup("snapshot", 2<<10, getter)
+	g.setLocally("Tom", []byte("630"), time.Time{})
+	g.setLocally("Jack", []byte("589"), time.Now().Add(time.Hour))
+	g.setLocally("Sam", []byte("567"), time.Now().Add(-time.Second))
+	g.setLocally("Ann", []byte("600"), time.Time{})
+	g.Get("Tom") // Tom becomes the most recently used
+
+	var buf bytes.Buffer
+	if err := g.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	restored := NewGroup("snapshot-restored", 2<<10, getter)
+	if err := restored.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	restored.mainCache.walkShards(func(k []string, values []ByteView) error {
+		keys = append(keys, k...)
+		return nil
+	})
+	// Sam had expired, the rest keep their LRU order
+	if want := []string{"Jack", "Ann", "Tom"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("restored %v, want %v", keys, want)
+	}
+	if view, ok := restored.mainCache.get("Jack"); !ok || view.String() != "589" || view.Expire().IsZero() {
+		t.Fatalf("restored Jack = %q expiring %v", view.String(), view.Expire())
+	}
+
+	for name, bad := range map[string][]byte{
+		"truncated": snapshot[:len(snapshot)-1],
+		"corrupt":   append([]byte("GDCS\x01x"), snapshot[6:]...),
+		"version":   append([]byte("GDCS\x03"), snapshot[5:]...),
+		"empty":     nil,
+	} {
+		g := NewGroup("snapshot-"+name, 2<<10, getter)
+		if err := g.Restore(bytes.NewReader(bad)); !errors.Is(err, ErrBadSnapshot) {
+			t.Fatalf("%s snapshot: Restore() = %v, want ErrBadSnapshot", name, err)
+		}
+		if s := g.CacheStats(MainCache); s.Items != 0 {
+			t.Fatalf("%s snapshot: restored %d items", name, s.Items)
+		}
+	}
+}
+
+func TestSnapshotMaxAge(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("db-" + key), nil
+	})
+	g := NewGroup("snapshot-max-age", 2<<10, getter)
+	g.setLocally("Tom", []byte("630"), time.Time{})
+	var buf bytes.Buffer
+	if err := g.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := NewGroup("snapshot-max-age-fresh", 2<<10, getter, WithSnapshotMaxAge(time.Minute))
+	if err := fresh.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fresh.mainCache.get("Tom"); !ok {
+		t.Fatalf("Tom was not restored from a fresh snapshot")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	stale := NewGroup("snapshot-max-age-stale", 2<<10, getter, WithSnapshotMaxAge(time.Millisecond))
+	if err := stale.Restore(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrStaleSnapshot) {
+		t.Fatalf("Restore() of a stale snapshot = %v, want ErrStaleSnapshot", err)
+	}
+	if s := stale.CacheStats(MainCache); s.Items != 0 {
+		t.Fatalf("restored %d items from a stale snapshot", s.Items)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	store, err := diskcache.Open(filepath.Join(t.TempDir(), "l2.log"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	loads := make(map[string]int)
+	// room for two of the keys in memory
+	g := NewGroup("disk-cache", int64(2*len("key1value1")), GetterFunc(
+		func(key string) ([]byte, error) {
+			loads[key]++
+			return []byte("value" + key[3:]), nil
+		}), WithDiskCache(store))
+
+	for _, k := range []string{"key1", "key2", "key3"} {
+		g.Get(k)
+	}
+	g.disk.flush()
+	if store.Len() != 1 {
+		t.Fatalf("%d entries spilled to disk, want 1", store.Len())
+	}
+	if view, err := g.Get("key1"); err != nil || view.String() != "value1" {
+		t.Fatalf("Get(key1) = %q, %v", view.String(), err)
+	}
+	if loads["key1"] != 1 || g.Stats().DiskHits != 1 {
+		t.Fatalf("key1 loaded %d times, %d disk hits, want it served from disk", loads["key1"], g.Stats().DiskHits)
+	}
+
+	g.Remove("key1")
+	if _, err := g.disk.get("key1"); !errors.Is(err, diskcache.ErrNotFound) {
+		t.Fatalf("Remove kept key1 in the disk tier")
+	}
+	g.disk.flush()
+	if _, err := store.Get("key1"); !errors.Is(err, diskcache.ErrNotFound) {
+		t.Fatalf("Remove kept key1 on disk")
+	}
+}
+
+func TestDiskTier(t *testing.T) {
+	store, err := diskcache.Open(filepath.Join(t.TempDir(), "l2.log"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	d := newDiskTier(store)
+	d.start.Do(func() {}) // no background writer, the test flushes itself
+
+	d.put("key1", ByteView{b: []byte("v1")})
+	d.put("key2", ByteView{b: []byte("v2")})
+	if v, err := d.get("key1"); err != nil || v.String() != "v1" {
+		t.Fatalf("pending get(key1) = %q, %v", v.String(), err)
+	}
+	d.del("key2")
+	d.flush()
+	if store.Len() != 1 {
+		t.Fatalf("%d entries written, want only key1", store.Len())
+	}
+	if _, err := d.get("key2"); !errors.Is(err, diskcache.ErrNotFound) {
+		t.Fatalf("get(key2) = %v after del, want ErrNotFound", err)
+	}
+
+	// deleting a key already on disk is queued like a put
+	d.del("key1")
+	if _, err := d.get("key1"); !errors.Is(err, diskcache.ErrNotFound) || store.Len() != 1 {
+		t.Fatalf("get(key1) = %v after del with %d entries on disk, want a queued delete", err, store.Len())
+	}
+	d.flush()
+	if store.Len() != 0 {
+		t.Fatalf("%d entries on disk after the delete was written", store.Len())
+	}
+}
+
+func TestDiskCacheDropsReplacedValue(t *testing.T) {
+	store, err := diskcache.Open(filepath.Join(t.TempDir(), "l2.log"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	g := NewGroup("disk-cache-set", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db"), nil
+		}), WithDiskCache(store))
+	g.spillToDisk("key1", ByteView{b: []byte("v1")})
+
+	// the new value expires instead of being evicted, the old one must not
+	// come back from disk
+	g.setLocally("key1", []byte("NEW"), time.Now().Add(10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	if view, err := g.Get("key1"); err != nil || view.String() != "db" {
+		t.Fatalf("Get(key1) = %q, %v, want db", view.String(), err)
+	}
+}
+
+// batchGetter counts its calls and cannot load keys starting with "x".
+type batchGetter struct {
+	calls int
+}
+
+func (b *batchGetter) Get(key string) ([]byte, error) {
+	return nil, fmt.Errorf("Get(%s) called on a BatchGetter", key)
+}
+
+func (b *batchGetter) GetMulti(_ context.Context, keys []string) (map[string][]byte, error) {
+	b.calls++
+	res := make(map[string][]byte)
+	for _, key := range keys {
+		if key[0] != 'x' {
+			res[key] = []byte("db-" + key)
+		}
+	}
+	return res, nil
+}
+
+func TestGetMulti(t *testing.T) {
+	getter := &batchGetter{}
+	g := NewGroup("get-multi", 2<<10, getter)
+	g.Set("Tom", []byte("630"))
+
+	res, err := g.GetMulti([]string{"Tom", "Jack", "Sam", "Jack", "xTom"})
+	if err == nil {
+		t.Fatalf("GetMulti did not report xTom")
+	}
+	want := map[string]string{"Tom": "630", "Jack": "db-Jack", "Sam": "db-Sam"}
+	got := make(map[string]string)
+	for k, v := range res {
+		got[k] = v.String()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetMulti = %v, want %v", got, want)
+	}
+	if getter.calls != 1 {
+		t.Fatalf("BatchGetter called %d times, want 1", getter.calls)
+	}
+	if s := g.Stats(); s.Gets != 4 || s.CacheHits != 1 || s.LocalLoads != 2 || s.LocalLoadErrs != 1 {
+		t.Fatalf("Stats() = %+v", s)
+	}
+}
+
+func TestGetMultiPeers(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{"Tom": []byte("630"), "Jack": []byte("589")}}
+	g := NewGroup("get-multi-peers", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	g.RegisterPeers(&fakePeers{owner: owner})
+
+	res, err := g.GetMulti([]string{"Tom", "Jack", "Sam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sam is missing on the owner and falls back to the local Getter
+	if res["Tom"].String() != "630" || res["Jack"].String() != "589" || res["Sam"].String() != "db-Sam" {
+		t.Fatalf("GetMulti = %v", res)
+	}
+	if owner.batches != 1 || owner.gets != 0 {
+		t.Fatalf("owner got %d batches and %d Gets, want a single batch", owner.batches, owner.gets)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	loads := 0
+	g := NewGroup("negative", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), WithNegativeCache(time.Hour, 1<<10))
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(unknown) err = %v, want ErrNotFound", err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("Getter called %d times, want 1", loads)
+	}
+
+	// a Set replaces the negative entry
+	if err := g.Set("unknown", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := g.Get("unknown"); err != nil || v.String() != "v" {
+		t.Fatalf("Get(unknown) = %q, %v after Set", v, err)
+	}
+}
+
+func TestNegativeCacheFromPeer(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{}, notFound: true}
+	loads := 0
+	g := NewGroup("negative-peer", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte("db-" + key), nil
+		}))
+	g.RegisterPeers(&fakePeers{owner: owner})
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Get("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(unknown) err = %v, want ErrNotFound", err)
+		}
+	}
+	// the owner's NOT_FOUND is final and cached, not retried locally
+	if owner.gets != 1 || loads != 0 {
+		t.Fatalf("owner got %d Gets and Getter %d calls, want 1 and 0", owner.gets, loads)
+	}
+}
+
+func TestPeerErrorFallback(t *testing.T) {
+	tests := []struct {
+		err      error
+		fallback bool
+	}{
+		{errors.New("connection refused"), true},
+		{&PeerError{Status: pb.Status_INTERNAL}, true},
+		{&PeerError{Status: pb.Status_OVERLOADED}, true},
+		{&PeerError{Status: pb.Status_NO_SUCH_GROUP}, true},
+		{&PeerError{Status: pb.Status_TIMEOUT}, false},
+	}
+	for i, tt := range tests {
+		owner := &fakePeer{fail: tt.err}
+		loads := 0
+		g := NewGroup(fmt.Sprintf("peer-error-%d", i), 2<<10, GetterFunc(
+			func(key string) ([]byte, error) {
+				loads++
+				return []byte("db-" + key), nil
+			}))
+		g.RegisterPeers(&fakePeers{owner: owner})
+
+		v, err := g.Get("Tom")
+		if tt.fallback && (err != nil || v.String() != "db-Tom" || loads != 1) {
+			t.Errorf("%v: Get = %q, %v after %d loads, want a local load", tt.err, v, err, loads)
+		}
+		if !tt.fallback && (!errors.Is(err, tt.err) || loads != 0) {
+			t.Errorf("%v: Get err = %v after %d loads, want the peer's error", tt.err, err, loads)
+		}
+	}
+}
+
+func TestPeerRetries(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{"Tom": []byte("630")}, fail: errors.New("connection reset"), failFirst: 2}
+	loads := 0
+	g := NewGroup("peer-retries", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte("db-" + key), nil
+		}), WithPeerRetries(2, time.Millisecond))
+	g.RegisterPeers(&fakePeers{owner: owner})
+
+	if v, err := g.Get("Tom"); err != nil || v.String() != "630" {
+		t.Fatalf("Get = %q, %v, want 630 from the owner", v, err)
+	}
+	if s := g.Stats(); s.PeerRetries != 2 || loads != 0 {
+		t.Fatalf("PeerRetries = %d and %d local loads, want 2 and 0", s.PeerRetries, loads)
+	}
+
+	// what the peer answered is never retried
+	owner.gets, owner.fail, owner.failFirst = 0, &PeerError{Status: pb.Status_INTERNAL}, 0
+	g.Get("Jack")
+	if owner.gets != 1 {
+		t.Fatalf("owner got %d Gets for a PeerError, want 1", owner.gets)
+	}
+}
+
+func TestHedging(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{"Tom": []byte("630")}, delay: 200 * time.Millisecond}
+	g := NewGroup("hedging", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}), WithHedging(10*time.Millisecond))
+	g.RegisterPeers(&fakePeers{owner: owner})
+
+	start := time.Now()
+	if v, err := g.Get("Tom"); err != nil || v.String() != "db-Tom" {
+		t.Fatalf("Get = %q, %v, want the hedged local load", v, err)
+	}
+	if d := time.Since(start); d >= owner.delay {
+		t.Fatalf("hedged Get took %v, as long as the slow peer", d)
+	}
+	if s := g.Stats(); s.PeerHedges != 1 || s.HedgeWins != 1 || s.LocalLoads != 1 || s.PeerLoads != 0 {
+		t.Fatalf("Stats() = %+v", s)
+	}
+}
+
+// ownerPeers makes this node the owner of every key, with its replicas on
+// the peers after it.
+type ownerPeers struct {
+	fakePeers
+	successors []*fakePeer
+}
+
+func (p *ownerPeers) PickPeer(key string) (PeerGetter, bool) { return nil, false }
+
+func (p *ownerPeers) PickReplicas(key string, n int) []PeerGetter {
+	var res []PeerGetter
+	for _, s := range p.successors {
+		if len(res) < n-1 {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// successorPeers routes every key to owner, this node being one of the
+// successors that keep its replicas.
+type successorPeers struct {
+	ownerPeers
+}
+
+func (p *successorPeers) PickPeer(key string) (PeerGetter, bool) { return p.owner, true }
+
+func TestHotRetractionKeepsReplicas(t *testing.T) {
+	g := NewGroup("hot-retraction-replicas", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithReplication(3), WithHotKeyReplication(time.Hour, 1, 3))
+	owner := &fakePeer{data: map[string][]byte{}}
+	next := &fakePeer{data: map[string][]byte{}}
+	g.RegisterPeers(&successorPeers{ownerPeers{fakePeers: fakePeers{owner: owner}, successors: []*fakePeer{next}}})
+
+	// this node keeps a replica of Tom and, while it is hot, a hot copy
+	g.setFromPeer("Tom", &pb.Request{Value: []byte("630"), Replica: true})
+	g.setFromPeer("Tom", &pb.Request{Value: []byte("630"), Hot: true})
+
+	// the owner retracting Tom only drops the hot copy
+	g.removeFromPeer("Tom", &pb.Request{Key: "Tom", Hot: true})
+	if _, ok := g.hotCache.get("Tom"); ok {
+		t.Fatalf("hot copy of Tom was not retracted")
+	}
+	if v, ok := g.mainCache.get("Tom"); !ok || v.String() != "630" {
+		t.Fatalf("replica of Tom was dropped by the retraction")
+	}
+
+	// a Remove reaching a non-owner, as Invalidate sends, is not passed on
+	g.removeFromPeer("Tom", &pb.Request{Key: "Tom"})
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("replica of Tom was not removed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(owner.removed) != 0 || len(next.removed) != 0 {
+		t.Fatalf("non-owner dropped replicas on %v and %v", owner.removed, next.removed)
+	}
+}
+
+// ringPeers routes every key to the first of nodes, with its replicas on
+// the nodes after it and none on this node.
+type ringPeers struct {
+	fakePeers
+	nodes []*fakePeer
+}
+
+func (p *ringPeers) PickPeer(key string) (PeerGetter, bool) { return p.nodes[0], true }
+
+func (p *ringPeers) PickReplicas(key string, n int) []PeerGetter {
+	var res []PeerGetter
+	for _, node := range p.nodes {
+		if len(res) < n {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+func TestReplicaFailover(t *testing.T) {
+	owner := &fakePeer{data: map[string][]byte{}, fail: ErrCircuitOpen}
+	next := &fakePeer{data: map[string][]byte{"Tom": []byte("630")}}
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("db-" + key), nil
+	})
+
+	// with replicas, a key whose owner's breaker is open is asked of the
+	// next peer keeping a replica of it
+	g := NewGroup("replica-failover", 2<<10, getter, WithReplication(2))
+	g.RegisterPeers(&ringPeers{nodes: []*fakePeer{owner, next}})
+	if view, err := g.Get("Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("Get with the owner's breaker open = %q, %v, want 630", view.String(), err)
+	}
+	if next.gets != 1 {
+		t.Fatalf("replica got %d requests, want 1", next.gets)
+	}
+
+	// without replicas it is loaded locally, as with any open breaker
+	g = NewGroup("replica-failover-off", 2<<10, getter)
+	g.RegisterPeers(&ringPeers{nodes: []*fakePeer{owner, next}})
+	if view, err := g.Get("Tom"); err != nil || view.String() != "db-Tom" {
+		t.Fatalf("Get without replicas = %q, %v, want db-Tom", view.String(), err)
+	}
+	if next.gets != 1 {
+		t.Fatalf("replica was asked without WithReplication")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	g := NewGroup("replication", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}), WithReplication(2))
+	first := &fakePeer{data: map[string][]byte{}}
+	second := &fakePeer{data: map[string][]byte{}}
+	g.RegisterPeers(&ownerPeers{successors: []*fakePeer{first, second}})
+
+	// the owner pushes to n-1 successors only
+	g.replicate("Tom", ByteView{b: []byte("630")})
+	if !reflect.DeepEqual(first.replica, []string{"Tom"}) || string(first.data["Tom"]) != "630" || len(second.replica) != 0 {
+		t.Fatalf("replicated to %v and %v, want only the first successor", first.replica, second.replica)
+	}
+	g.dropReplicas("Tom")
+	if _, ok := first.data["Tom"]; ok {
+		t.Fatalf("replica of Tom was not dropped")
+	}
+
+	// a replica pushed here lands in the main cache and is not pushed on
+	g.setFromPeer("Jack", &pb.Request{Value: []byte("589"), Replica: true})
+	if v, ok := g.mainCache.get("Jack"); !ok || v.String() != "589" {
+		t.Fatalf("replica of Jack is not in the main cache")
+	}
+	if len(first.replica) != 1 {
+		t.Fatalf("a received replica was pushed on to %v", first.replica)
+	}
+}
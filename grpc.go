@@ -0,0 +1,284 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"GoDistributedCache/consistenthash"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCPool implements PeerPicker for a pool of gRPC peers, and serves the
+// GroupCache service declared in cachepb.proto for them.
+// Unlike HTTPPool it keeps one multiplexed connection per peer for as long
+// as the peer stays in the pool.
+type GRPCPool struct {
+	// this peer's address, e.g. "10.0.0.1:8001"
+	self        string
+	mu          sync.RWMutex // guards peers and grpcGetters
+	peers       *consistenthash.HashNodes
+	grpcGetters map[string]*grpcGetter // keyed by e.g. "10.0.0.2:8001"
+	creds       credentials.TransportCredentials
+}
+
+// A GRPCPoolOption configures how a GRPCPool talks to its peers.
+type GRPCPoolOption func(*GRPCPool)
+
+// WithGRPCTLS makes the pool dial peers over TLS with cfg, usually from
+// NewMutualTLSConfig. The grpc.Server the pool is registered on must be
+// created with grpc.Creds(credentials.NewTLS(cfg)) too, so that it only
+// answers peers holding a certificate the same CA signed.
+func WithGRPCTLS(cfg *tls.Config) GRPCPoolOption {
+	return func(p *GRPCPool) {
+		p.creds = credentials.NewTLS(cfg)
+	}
+}
+
+// NewGRPCPool initializes a gRPC pool of peers.
+func NewGRPCPool(self string, opts ...GRPCPoolOption) *GRPCPool {
+	p := &GRPCPool{
+		self:        self,
+		grpcGetters: make(map[string]*grpcGetter),
+		creds:       insecure.NewCredentials(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Log info with server name
+func (p *GRPCPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// Register serves the GroupCache service for the pool's peers on s.
+func (p *GRPCPool) Register(s *grpc.Server) {
+	pb.RegisterGroupCacheServer(s, &grpcServer{pool: p})
+}
+
+// Set updates the pool's list of peers. Connections to peers that are
+// still present are kept, those to removed peers are closed.
+func (p *GRPCPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers = consistenthash.NewHashNodes(defaultReplicas, nil)
+	p.peers.Add(peers...)
+	getters := make(map[string]*grpcGetter, len(peers))
+	for _, peer := range peers {
+		if getter, ok := p.grpcGetters[peer]; ok {
+			getters[peer] = getter
+			continue
+		}
+		getter, err := newGRPCGetter(peer, p.creds)
+		if err != nil {
+			p.Log("connect to peer %s: %v", peer, err)
+			continue
+		}
+		getters[peer] = getter
+	}
+	for peer, getter := range p.grpcGetters {
+		if _, ok := getters[peer]; !ok {
+			getter.conn.Close()
+		}
+	}
+	p.grpcGetters = getters
+}
+
+// PickPeer picks a peer according to key.
+func (p *GRPCPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != "" && peer != p.self {
+		if getter, ok := p.grpcGetters[peer]; ok {
+			p.Log("Pick peer %s", peer)
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+// PickReplicas returns the peers among the first n nodes for key, leaving
+// this node out.
+func (p *GRPCPool) PickReplicas(key string, n int) []PeerGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.peers == nil {
+		return nil
+	}
+	var res []PeerGetter
+	for _, peer := range p.peers.GetN(key, n) {
+		if getter, ok := p.grpcGetters[peer]; ok && peer != p.self {
+			res = append(res, getter)
+		}
+	}
+	return res
+}
+
+// AllPeers returns the getters of every peer except this one.
+func (p *GRPCPool) AllPeers() []PeerGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]PeerGetter, 0, len(p.grpcGetters))
+	for peer, getter := range p.grpcGetters {
+		if peer != p.self {
+			res = append(res, getter)
+		}
+	}
+	return res
+}
+
+func (p *GRPCPool) writeMetrics(w io.Writer) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var nodes, virtualNodes int
+	if p.peers != nil {
+		nodes, virtualNodes = p.peers.Nodes(), p.peers.Len()
+	}
+	latencies := make(map[string]*histogram, len(p.grpcGetters))
+	for peer, getter := range p.grpcGetters {
+		latencies[peer] = getter.latency
+	}
+	writePeerMetrics(w, nodes, virtualNodes, latencies)
+}
+
+// GetPeers peers from cache
+func (p *GRPCPool) GetPeers() (res string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var output strings.Builder
+	for peer := range p.grpcGetters {
+		ip, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			output.WriteString(fmt.Sprintf("Peer: %s\n", peer))
+		} else {
+			output.WriteString(fmt.Sprintf("Peer: %s, IP: %s, Port: %s\n", peer, ip, port))
+		}
+	}
+	return output.String()
+}
+
+// grpcServer implements pb.GroupCacheServer on behalf of a GRPCPool, whose
+// own Set already means updating the peer list.
+type grpcServer struct {
+	pb.UnimplementedGroupCacheServer
+	pool *GRPCPool
+}
+
+func (s *grpcServer) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	s.pool.Log("Get %s/%s", in.GetGroup(), in.GetKey())
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "no such group: %s", in.GetGroup())
+	}
+	group.servePeer(in.GetKey())
+	view, err := group.GetContext(ctx, in.GetKey())
+	if errors.Is(err, ErrNotFound) {
+		return &pb.Response{Status: pb.Status_NOT_FOUND}, nil
+	}
+	if err != nil {
+		return nil, status.Error(grpcCode(statusOf(err)), err.Error())
+	}
+	return &pb.Response{Value: view.ByteSlice(), Expire: expireToNano(view.Expire())}, nil
+}
+
+func (s *grpcServer) Set(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "no such group: %s", in.GetGroup())
+	}
+	group.setFromPeer(in.GetKey(), in)
+	return &pb.Response{}, nil
+}
+
+func (s *grpcServer) GetMulti(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "no such group: %s", in.GetGroup())
+	}
+	return group.serveGetMulti(ctx, in.GetKeys()), nil
+}
+
+func (s *grpcServer) Remove(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	group := GetGroup(in.GetGroup())
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "no such group: %s", in.GetGroup())
+	}
+	group.removeFromPeer(in.GetKey(), in)
+	return &pb.Response{}, nil
+}
+
+type grpcGetter struct {
+	conn    *grpc.ClientConn
+	client  pb.GroupCacheClient
+	latency *histogram
+}
+
+func newGRPCGetter(addr string, creds credentials.TransportCredentials) (*grpcGetter, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcGetter{
+		conn:    conn,
+		client:  pb.NewGroupCacheClient(conn),
+		latency: newHistogram(peerLatencyBuckets),
+	}, nil
+}
+
+func (g *grpcGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	defer g.latency.observeSince(time.Now())
+	res, err := g.client.Get(ctx, in)
+	if err != nil {
+		return fromGRPC(err)
+	}
+	proto.Merge(out, res)
+	return nil
+}
+
+func (g *grpcGetter) Set(ctx context.Context, in *pb.Request) error {
+	_, err := g.client.Set(ctx, in)
+	return fromGRPC(err)
+}
+
+func (g *grpcGetter) Remove(ctx context.Context, in *pb.Request) error {
+	_, err := g.client.Remove(ctx, in)
+	return fromGRPC(err)
+}
+
+func (g *grpcGetter) GetMulti(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	defer g.latency.observeSince(time.Now())
+	res, err := g.client.GetMulti(ctx, in)
+	if err != nil {
+		return fromGRPC(err)
+	}
+	proto.Merge(out, res)
+	return nil
+}
+
+// fromGRPC rebuilds the PeerError behind a status the peer answered with.
+// Transport failures, e.g. an unreachable peer, are returned as they are.
+func fromGRPC(err error) error {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() == codes.OK || s.Code() == codes.Unavailable || s.Code() == codes.Canceled {
+		return err
+	}
+	return &PeerError{Status: statusFromGRPC(s.Code()), Msg: s.Message()}
+}
@@ -0,0 +1,53 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"testing"
+)
+
+func TestGRPCServer(t *testing.T) {
+	g := NewGroup("grpc-server", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	srv := &grpcServer{pool: NewGRPCPool("self:8001")}
+	ctx := context.Background()
+
+	res, err := srv.Get(ctx, &pb.Request{Group: g.name, Key: "Tom"})
+	if err != nil || string(res.GetValue()) != "db-Tom" {
+		t.Fatalf("Get = %q, %v, want db-Tom", res.GetValue(), err)
+	}
+	if _, err = srv.Set(ctx, &pb.Request{Group: g.name, Key: "Tom", Value: []byte("700")}); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := g.mainCache.get("Tom"); !ok || view.String() != "700" {
+		t.Fatalf("Set did not populate the cache, got %q", view.String())
+	}
+	if _, err = srv.Remove(ctx, &pb.Request{Group: g.name, Key: "Tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("Remove did not remove the key")
+	}
+	if _, err = srv.Get(ctx, &pb.Request{Group: "no-such-group", Key: "Tom"}); err == nil {
+		t.Fatalf("Get on an unknown group should fail")
+	}
+}
+
+func TestGRPCPoolKeepsConnections(t *testing.T) {
+	pool := NewGRPCPool("10.0.0.1:8001")
+	pool.Set("10.0.0.1:8001", "10.0.0.2:8001", "10.0.0.3:8001")
+	conn := pool.grpcGetters["10.0.0.2:8001"]
+
+	pool.Set("10.0.0.1:8001", "10.0.0.2:8001")
+	if pool.grpcGetters["10.0.0.2:8001"] != conn {
+		t.Fatalf("Set redialed a peer that stayed in the pool")
+	}
+	if _, ok := pool.grpcGetters["10.0.0.3:8001"]; ok {
+		t.Fatalf("Set kept a peer that left the pool")
+	}
+	if n := len(pool.AllPeers()); n != 1 {
+		t.Fatalf("AllPeers returned %d peers, want 1", n)
+	}
+}
@@ -0,0 +1,150 @@
+package GoDistributedCache
+
+import (
+	"GoDistributedCache/consistenthash"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// healthPath, under basePath, answers 200 while the node is serving
+	healthPath = "_health"
+
+	defaultHealthInterval = 5 * time.Second
+	defaultEjectAfter     = 3
+	defaultReinstateAfter = 2
+)
+
+// peerHealth tracks whether a peer answers. A peer that failed ejectAfter
+// requests or probes in a row is down and left out of routing, until
+// reinstateAfter probes in a row succeed.
+type peerHealth struct {
+	mu        sync.Mutex
+	failures  int // in a row
+	successes int // probes in a row since going down
+	down      bool
+}
+
+// observe records the outcome of a request or probe to the peer and
+// reports whether that took it down or brought it back up. Only probes
+// bring a down peer back, as nothing else is sent to it.
+func (h *peerHealth) observe(ok, probe bool, ejectAfter, reinstateAfter int) (changed, down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !ok {
+		h.successes = 0
+		h.failures++
+		if !h.down && h.failures >= ejectAfter {
+			h.down = true
+			return true, true
+		}
+		return false, h.down
+	}
+	h.failures = 0
+	if h.down && probe {
+		h.successes++
+		if h.successes >= reinstateAfter {
+			h.down, h.successes = false, 0
+			return true, false
+		}
+	}
+	return false, h.down
+}
+
+func (h *peerHealth) isDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down
+}
+
+// observePeer feeds the outcome of a request or probe to peer into its
+// health, and reroutes its keys if that took it down or brought it back.
+func (p *HTTPPool) observePeer(peer string, h *peerHealth, ok, probe bool) {
+	if p.healthInterval <= 0 {
+		return
+	}
+	changed, down := h.observe(ok, probe, p.ejectAfter, p.reinstateAfter)
+	if !changed {
+		return
+	}
+	if down {
+		p.Log("Peer %s is down, removing it from the ring", peer)
+	} else {
+		p.Log("Peer %s is back, adding it to the ring", peer)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buildRing()
+}
+
+// buildRing puts this node and every peer that is not down on the ring.
+// p.mu must be held.
+func (p *HTTPPool) buildRing() {
+	up := make([]string, 0, len(p.peerList))
+	for _, peer := range p.peerList {
+		if h, ok := p.health[peer]; peer == p.self || !ok || !h.isDown() {
+			up = append(up, peer)
+		}
+	}
+	p.peers = consistenthash.NewHashNodes(defaultReplicas, nil)
+	p.peers.Add(up...)
+}
+
+// probePeers probes every peer each healthInterval, so wedged peers are
+// ejected before traffic hits them and ejected ones come back once they
+// recover.
+func (p *HTTPPool) probePeers() {
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.RLock()
+		getters := make(map[string]*httpGetter, len(p.httpGetters))
+		for peer, getter := range p.httpGetters {
+			if peer != p.self {
+				getters[peer] = getter
+			}
+		}
+		health := p.health
+		p.mu.RUnlock()
+
+		var wg sync.WaitGroup
+		for peer, getter := range getters {
+			wg.Add(1)
+			go func(peer string, getter *httpGetter) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), p.healthInterval)
+				defer cancel()
+				p.observePeer(peer, health[peer], getter.probe(ctx) == nil, true)
+			}(peer, getter)
+		}
+		wg.Wait()
+	}
+}
+
+// probe asks the peer whether it is serving. Unlike other requests it
+// leaves the passive health tracking alone, probePeers records it.
+func (h *httpGetter) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.baseURL+healthPath, nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned: %v", res.Status)
+	}
+	return nil
+}
+
+// serveHealth answers health probes. Anything that can reach the node may
+// ask, the answer tells nothing about the cached data.
+func (p *HTTPPool) serveHealth(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,306 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"container/heap"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hotKeySlots is the number of slots the sliding window is divided into.
+	hotKeySlots = 6
+	// hotKeyCounters is how many keys a slot counts per hot key wanted, so
+	// the detector's memory depends on topK, not on how many keys are read.
+	hotKeyCounters = 16
+	// defaultHotKeyWindow and defaultHotKeyTopK replace a window too short
+	// to be divided into slots and a topK below 1.
+	defaultHotKeyWindow = time.Minute
+	defaultHotKeyTopK   = 10
+)
+
+// hotKeyReplicator runs on the owner of keys. It counts the Gets it serves
+// to peers over a sliding window, and copies the top keys into every peer's
+// hot cache so that a single viral key stops hammering its owner. Peers
+// serve their copy until the owner retracts it, once the key has cooled
+// down, or until its lease of one window runs out.
+type hotKeyReplicator struct {
+	g        *Group
+	tick     time.Duration // length of a slot
+	lease    time.Duration // how long peers may serve a pushed copy
+	topK     int
+	minCount int64
+
+	mu    sync.Mutex
+	slots []*topKCounter // request counts per slot, the last one is current
+	hot   map[string]bool
+}
+
+func newHotKeyReplicator(g *Group, window time.Duration, topK int, minCount int64) *hotKeyReplicator {
+	if window < hotKeySlots {
+		window = defaultHotKeyWindow
+	}
+	if topK < 1 {
+		topK = defaultHotKeyTopK
+	}
+	// 保证计数为 0 的 key 不能算热点
+	minCount = max(minCount, 1)
+	r := &hotKeyReplicator{
+		g:        g,
+		tick:     window / hotKeySlots,
+		lease:    window,
+		topK:     topK,
+		minCount: minCount,
+		slots:    make([]*topKCounter, hotKeySlots),
+		hot:      make(map[string]bool),
+	}
+	for i := range r.slots {
+		r.slots[i] = newTopKCounter(topK * hotKeyCounters)
+	}
+	return r
+}
+
+// record counts a Get served to a peer.
+func (r *hotKeyReplicator) record(key string) {
+	r.mu.Lock()
+	r.slots[len(r.slots)-1].add(key)
+	r.mu.Unlock()
+}
+
+func (r *hotKeyReplicator) isHot(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hot[key]
+}
+
+// forget stops treating key as hot and reports whether it was.
+func (r *hotKeyReplicator) forget(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, slot := range r.slots {
+		slot.remove(key)
+	}
+	if !r.hot[key] {
+		return false
+	}
+	delete(r.hot, key)
+	return true
+}
+
+// rotate picks the hot keys of the window that just ended, then slides the
+// window by one slot. It returns every hot key, so their leases can be
+// renewed, and the keys that are no longer hot.
+func (r *hotKeyReplicator) rotate() (hot, retracted []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// minCount 只看保证计数，避免扫描流量里继承来的计数把冷 key 算成热点
+	totals := make(map[string]int64)
+	guaranteed := make(map[string]int64)
+	for _, slot := range r.slots {
+		for key, kc := range slot.counts {
+			totals[key] += kc.n
+			guaranteed[key] += kc.n - kc.err
+		}
+	}
+	for key, n := range guaranteed {
+		if n >= r.minCount {
+			hot = append(hot, key)
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if totals[hot[i]] != totals[hot[j]] {
+			return totals[hot[i]] > totals[hot[j]]
+		}
+		return hot[i] < hot[j]
+	})
+	if len(hot) > r.topK {
+		hot = hot[:r.topK]
+	}
+
+	next := make(map[string]bool, len(hot))
+	for _, key := range hot {
+		next[key] = true
+	}
+	for key := range r.hot {
+		if !next[key] {
+			retracted = append(retracted, key)
+		}
+	}
+	r.hot = next
+
+	// 最旧的 slot 清空后重新用作当前 slot
+	oldest := r.slots[0]
+	copy(r.slots, r.slots[1:])
+	oldest.reset()
+	r.slots[len(r.slots)-1] = oldest
+	return hot, retracted
+}
+
+func (r *hotKeyReplicator) run() {
+	ticker := time.NewTicker(r.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.replicate()
+	}
+}
+
+// replicate pushes the current hot keys to every peer and retracts those
+// that cooled down.
+func (r *hotKeyReplicator) replicate() {
+	hot, retracted := r.rotate()
+	var sets, removes []*pb.Request
+	for _, key := range hot {
+		if req, ok := r.pushRequest(key); ok {
+			sets = append(sets, req)
+		}
+	}
+	for _, key := range retracted {
+		removes = append(removes, r.retractRequest(key))
+	}
+	r.send(sets, removes)
+}
+
+// push copies the owner's value of key into the hot cache of every peer.
+func (r *hotKeyReplicator) push(key string) {
+	if req, ok := r.pushRequest(key); ok {
+		r.send([]*pb.Request{req}, nil)
+	}
+}
+
+// retract drops the copies of key that peers keep in their hot cache,
+// leaving the key's replicas and any other copy alone.
+func (r *hotKeyReplicator) retract(key string) {
+	r.send(nil, []*pb.Request{r.retractRequest(key)})
+}
+
+// pushRequest returns the Set that copies the owner's value of key into a
+// peer's hot cache, for at most one lease.
+func (r *hotKeyReplicator) pushRequest(key string) (*pb.Request, bool) {
+	// 复制不是用户的 Get，不计入 mainCache 的命中率
+	view, ok := r.g.mainCache.peek(key)
+	if !ok {
+		return nil, false
+	}
+	expire := time.Now().Add(r.lease)
+	if !view.e.IsZero() && view.e.Before(expire) {
+		expire = view.e
+	}
+	return &pb.Request{Group: r.g.name, Key: key, Value: view.b, Expire: expireToNano(expire), Hot: true}, true
+}
+
+func (r *hotKeyReplicator) retractRequest(key string) *pb.Request {
+	return &pb.Request{Group: r.g.name, Key: key, Hot: true}
+}
+
+// send sends sets and removes to every peer, to all peers at once, so a
+// slow peer only delays its own copies. It gives up on what is not sent
+// within one slot, the next rotation sends the hot keys again.
+func (r *hotKeyReplicator) send(sets, removes []*pb.Request) {
+	if r.g.peers == nil || len(sets)+len(removes) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.tick)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, peer := range r.g.peers.AllPeers() {
+		wg.Add(1)
+		go func(peer PeerGetter) {
+			defer wg.Done()
+			for _, req := range sets {
+				if err := peer.Set(ctx, req); err != nil {
+					log.Printf("[GoDistributedCache] push hot key %s: %v", req.GetKey(), err)
+				}
+			}
+			for _, req := range removes {
+				if err := peer.Remove(ctx, req); err != nil {
+					log.Printf("[GoDistributedCache] retract hot key %s: %v", req.GetKey(), err)
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// topKCounter counts requests per key in a fixed number of counters, with
+// the Space-Saving algorithm: once every counter is taken, a new key takes
+// over the counter of the least requested key and adds to its count. Counts
+// can thus be too high by what the key inherited, kept as err, but a key
+// requested more often than total/capacity times always keeps its counter.
+type topKCounter struct {
+	capacity int
+	counts   map[string]*keyCount
+	least    countHeap
+}
+
+type keyCount struct {
+	key   string
+	n     int64
+	err   int64 // how much of n was inherited from an evicted key
+	index int   // in countHeap
+}
+
+func newTopKCounter(capacity int) *topKCounter {
+	return &topKCounter{capacity: max(capacity, 1), counts: make(map[string]*keyCount)}
+}
+
+func (c *topKCounter) add(key string) {
+	if kc, ok := c.counts[key]; ok {
+		kc.n++
+		heap.Fix(&c.least, kc.index)
+		return
+	}
+	if len(c.least) < c.capacity {
+		kc := &keyCount{key: key, n: 1}
+		heap.Push(&c.least, kc)
+		c.counts[key] = kc
+		return
+	}
+	kc := c.least[0]
+	delete(c.counts, kc.key)
+	kc.key = key
+	kc.err = kc.n
+	kc.n++
+	c.counts[key] = kc
+	heap.Fix(&c.least, 0)
+}
+
+func (c *topKCounter) remove(key string) {
+	if kc, ok := c.counts[key]; ok {
+		heap.Remove(&c.least, kc.index)
+		delete(c.counts, key)
+	}
+}
+
+func (c *topKCounter) reset() {
+	clear(c.counts)
+	clear(c.least)
+	c.least = c.least[:0]
+}
+
+// countHeap is a min-heap of keyCount ordered by count.
+type countHeap []*keyCount
+
+func (h countHeap) Len() int           { return len(h) }
+func (h countHeap) Less(i, j int) bool { return h[i].n < h[j].n }
+func (h countHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *countHeap) Push(x interface{}) {
+	kc := x.(*keyCount)
+	kc.index = len(*h)
+	*h = append(*h, kc)
+}
+func (h *countHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
@@ -3,6 +3,10 @@ package GoDistributedCache
 import (
 	pb "GoDistributedCache/cachepb"
 	"GoDistributedCache/consistenthash"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"io"
@@ -12,11 +16,19 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	defaultBasePath = "/_mycache/"
 	defaultReplicas = 50
+	// batchPath, under basePath, takes a POSTed BatchRequest
+	batchPath = "_batch"
+
+	defaultDialTimeout         = 2 * time.Second
+	defaultResponseTimeout     = 5 * time.Second
+	defaultMaxIdleConnsPerHost = 32
+	defaultMaxRequestBytes     = 64 << 20
 )
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
@@ -29,15 +41,161 @@ type HTTPPool struct {
 	peers    *consistenthash.HashNodes
 	// httpGetters maps remote peer to its HTTPGetter keyed by e.g. "http://10.0.0.2:8008"
 	httpGetters map[string]*httpGetter
+	// latencies outlive the httpGetters, which Set recreates on every refresh
+	latencies map[string]*histogram
+	// client is shared by all httpGetters, so idle connections to a peer
+	// survive Set. dialer and transport are what the options tune.
+	client    *http.Client
+	dialer    *net.Dialer
+	transport *http.Transport
+	// tlsConfig, if set, is required of every peer request, secret, if set,
+	// signs them
+	tlsConfig *tls.Config
+	secret    []byte
+	nonces    nonceSet // of the signed requests answered recently
+	// maxRequestBytes bounds the body of a peer request
+	maxRequestBytes int64
+	// peerList is every peer given to Set, the ring only holds those that
+	// are not down. health outlives the httpGetters like latencies.
+	peerList       []string
+	health         map[string]*peerHealth
+	healthInterval time.Duration // zero turns health checking off
+	ejectAfter     int
+	reinstateAfter int
+	probeOnce      sync.Once
+	// breakers outlive the httpGetters too, nil breakerConfig turns them off
+	breakerConfig *BreakerConfig
+	breakers      map[string]*breaker
 	PeerPicker
 }
 
+// An HTTPPoolOption configures how an HTTPPool talks to its peers.
+type HTTPPoolOption func(*HTTPPool)
+
+// WithDialTimeout limits how long connecting to a peer may take.
+// Defaults to 2 seconds.
+func WithDialTimeout(d time.Duration) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.dialer.Timeout = d
+	}
+}
+
+// WithResponseTimeout limits how long a peer may take to start answering
+// once the request is sent, so a wedged peer fails fast even for callers
+// without a deadline. Defaults to 5 seconds, 0 means no limit.
+func WithResponseTimeout(d time.Duration) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.transport.ResponseHeaderTimeout = d
+	}
+}
+
+// WithMaxIdleConnsPerHost sets how many idle connections are kept open to
+// each peer. Defaults to 32.
+func WithMaxIdleConnsPerHost(n int) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithHTTP2 sets whether peers are asked to speak HTTP/2, which only
+// peers served over TLS agree to. Defaults to true.
+func WithHTTP2(enabled bool) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.transport.ForceAttemptHTTP2 = enabled
+	}
+}
+
+// WithHTTPClient makes the pool send peer requests with c as it is,
+// ignoring the other options.
+func WithHTTPClient(c *http.Client) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.client = c
+	}
+}
+
+// WithTLS makes the pool dial peers with cfg, usually from
+// NewMutualTLSConfig, and answer only requests that came over TLS with a
+// verified client certificate. The pool must then be served over TLS with
+// the same cfg, and peers be given as "https://" URLs.
+func WithTLS(cfg *tls.Config) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.tlsConfig = cfg
+		p.transport.TLSClientConfig = cfg
+	}
+}
+
+// WithSharedSecret makes the pool sign its peer requests with an HMAC of
+// secret, and answer only requests signed with it, for clusters where
+// issuing certificates is not an option. Every peer needs the same secret.
+func WithSharedSecret(secret []byte) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.secret = secret
+	}
+}
+
+// WithMaxRequestBytes limits the body of the requests the pool answers,
+// which hold at most one value or a batch of keys. Larger ones are turned
+// away with a 400 before being read to the end. Defaults to 64 MiB.
+func WithMaxRequestBytes(n int64) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.maxRequestBytes = n
+	}
+}
+
+// WithHealthCheck makes the pool probe each peer's health endpoint every
+// interval. A peer whose requests or probes fail ejectAfter times in a row
+// is taken off the ring, so its keys go to the next peer, until
+// reinstateAfter probes in a row succeed. Defaults to 5 seconds, 3 and 2,
+// an interval of 0 turns health checking off.
+func WithHealthCheck(interval time.Duration, ejectAfter, reinstateAfter int) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.healthInterval = interval
+		p.ejectAfter = ejectAfter
+		p.reinstateAfter = reinstateAfter
+	}
+}
+
+// WithCircuitBreaker sets the circuit breaker in front of each peer. While
+// a peer's breaker is open its requests fail with ErrCircuitOpen without
+// being sent, and Groups load the keys themselves, or with WithReplication
+// ask the peers keeping replicas of them. Defaults to
+// DefaultBreakerConfig, nil turns the breakers off.
+func WithCircuitBreaker(cfg *BreakerConfig) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.breakerConfig = cfg
+	}
+}
+
 // NewHTTPPool initializes an HTTP pool of peers.
-func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
+func NewHTTPPool(self string, opts ...HTTPPoolOption) *HTTPPool {
+	breakerConfig := DefaultBreakerConfig
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}
+	p := &HTTPPool{
 		self:     self,
 		basePath: defaultBasePath,
+		dialer:   dialer,
+		transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: defaultResponseTimeout,
+		},
+		maxRequestBytes: defaultMaxRequestBytes,
+		healthInterval:  defaultHealthInterval,
+		ejectAfter:      defaultEjectAfter,
+		reinstateAfter:  defaultReinstateAfter,
+		breakerConfig:   &breakerConfig,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.client == nil {
+		p.client = &http.Client{Transport: p.transport}
 	}
+	return p
 }
 
 // Log info with server name
@@ -54,11 +212,36 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.Log("%s %s", r.Method, r.URL.Path)
 	// 去掉 basePath 得到实际的路径
 	path := r.URL.Path[len(p.basePath):]
+	// 健康检查不需要认证，k8s 的探针也可以用
+	if path == healthPath {
+		p.serveHealth(w)
+		return
+	}
+	// 读 body 之前先拒绝肯定通不过认证的请求，body 的大小也有上限
+	if err := p.admit(r); err != nil {
+		writeError(w, pb.Status_UNAUTHENTICATED, err.Error())
+		return
+	}
+	// 签名覆盖了 body，所以先读出来再交给各个 handler
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, p.maxRequestBytes))
+	if err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	if err = p.authenticate(r, body); err != nil {
+		writeError(w, pb.Status_UNAUTHENTICATED, err.Error())
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if path == batchPath {
+		p.serveGetMulti(w, r)
+		return
+	}
 
 	// 处理 /<group>/<key> 请求
 	parts := strings.SplitN(path, "/", 2)
 	if len(parts) != 2 {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		writeError(w, pb.Status_BAD_REQUEST, "bad request")
 		return
 	}
 
@@ -67,17 +250,67 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	group := GetGroup(groupName)
 	if group == nil {
-		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		writeError(w, pb.Status_NO_SUCH_GROUP, "no such group: "+groupName)
 		return
 	}
 
-	view, err := group.Get(key)
+	switch r.Method {
+	case http.MethodGet:
+		p.serveGet(w, r, group, key)
+	case http.MethodPut:
+		p.serveSet(w, r, group, key)
+	case http.MethodDelete:
+		p.serveRemove(w, r, group, key)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *HTTPPool) serveGet(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	group.servePeer(key)
+	view, err := group.GetContext(r.Context(), key)
+	res := &pb.Response{Value: view.ByteSlice(), Expire: expireToNano(view.Expire())}
+	if errors.Is(err, ErrNotFound) {
+		// 不存在的 key 不算错误，用 status 告诉对方，对方可以缓存这个结果
+		res.Status = pb.Status_NOT_FOUND
+	} else if err != nil {
+		writeError(w, statusOf(err), err.Error())
+		return
+	}
+
+	body, err := proto.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
 
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+// serveGetMulti answers the BatchRequest in the body with a BatchResponse.
+func (p *HTTPPool) serveGetMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	req := &pb.BatchRequest{}
+	if err = proto.Unmarshal(body, req); err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	group := GetGroup(req.GetGroup())
+	if group == nil {
+		writeError(w, pb.Status_NO_SUCH_GROUP, "no such group: "+req.GetGroup())
+		return
+	}
+	body, err = proto.Marshal(group.serveGetMulti(r.Context(), req.GetKeys()))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -86,22 +319,106 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-// Set updates the pool's list of peers.
+// serveSet stores the value sent by the peer that routed a Group.Set here,
+// or by the owner of a hot key.
+func (p *HTTPPool) serveSet(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	req := &pb.Request{}
+	if err = proto.Unmarshal(body, req); err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	group.setFromPeer(key, req)
+}
+
+// serveRemove drops key for the owner routing a Group.Remove here, or for
+// the peer this node keeps a replica for. Older peers send no body.
+func (p *HTTPPool) serveRemove(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	req := &pb.Request{}
+	if err = proto.Unmarshal(body, req); err != nil {
+		writeError(w, pb.Status_BAD_REQUEST, err.Error())
+		return
+	}
+	group.removeFromPeer(key, req)
+}
+
+// writeError answers a failed peer request with status s, both as the HTTP
+// status code and in a Response body that httpGetter turns back into a
+// PeerError.
+func writeError(w http.ResponseWriter, s pb.Status, msg string) {
+	body, err := proto.Marshal(&pb.Response{Status: s, Error: msg})
+	if err != nil {
+		http.Error(w, msg, httpStatus(s))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(httpStatus(s))
+	w.Write(body)
+}
+
+// Set updates the pool's list of peers. Peers that were down stay off the
+// ring until their probes succeed again.
 func (p *HTTPPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.peers = consistenthash.NewHashNodes(defaultReplicas, nil)
-	p.peers.Add(peers...)
+	p.peerList = peers
 	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	latencies := make(map[string]*histogram, len(peers))
+	health := make(map[string]*peerHealth, len(peers))
+	breakers := make(map[string]*breaker, len(peers))
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		latency, ok := p.latencies[peer]
+		if !ok {
+			latency = newHistogram(peerLatencyBuckets)
+		}
+		latencies[peer] = latency
+		h, ok := p.health[peer]
+		if !ok {
+			h = &peerHealth{}
+		}
+		health[peer] = h
+		b, ok := p.breakers[peer]
+		if !ok && p.breakerConfig != nil {
+			b = newBreaker(*p.breakerConfig)
+		}
+		if b != nil {
+			breakers[peer] = b
+		}
+		peer := peer
+		p.httpGetters[peer] = &httpGetter{
+			baseURL: peer + p.basePath,
+			latency: latency,
+			client:  p.client,
+			secret:  p.secret,
+			breaker: b,
+			observe: func(ok bool) { p.observePeer(peer, h, ok, false) },
+		}
+	}
+	p.latencies = latencies
+	p.health = health
+	p.breakers = breakers
+	p.buildRing()
+	if p.healthInterval > 0 {
+		p.probeOnce.Do(func() { go p.probePeers() })
 	}
 }
 
 // PickPeer picks a peer according to key.
+// It picks the owner even while the owner's circuit breaker is open; the
+// Group then loads the key itself, or with WithReplication asks the peers
+// keeping its replicas.
 func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	if peer := p.peers.Get(key); peer != "" && peer != p.self {
 		p.Log("Pick peer %s", peer)
 		return p.httpGetters[peer], true
@@ -109,16 +426,61 @@ func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	return nil, false
 }
 
+// PickReplicas returns the peers among the first n nodes for key, leaving
+// this node out.
+func (p *HTTPPool) PickReplicas(key string, n int) []PeerGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var res []PeerGetter
+	for _, peer := range p.peers.GetN(key, n) {
+		if peer != p.self {
+			res = append(res, p.httpGetters[peer])
+		}
+	}
+	return res
+}
+
+// AllPeers returns the getters of every peer except this one.
+func (p *HTTPPool) AllPeers() []PeerGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]PeerGetter, 0, len(p.httpGetters))
+	for peer, getter := range p.httpGetters {
+		if peer != p.self {
+			res = append(res, getter)
+		}
+	}
+	return res
+}
+
+func (p *HTTPPool) writeMetrics(w io.Writer) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var nodes, virtualNodes int
+	if p.peers != nil {
+		nodes, virtualNodes = p.peers.Nodes(), p.peers.Len()
+	}
+	writePeerMetrics(w, nodes, virtualNodes, p.latencies)
+}
+
 // GetPeers peers from cache
 func (p *HTTPPool) GetPeers() (res string) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	var output strings.Builder
 	for peer := range p.httpGetters {
+		// 被健康检查摘除的 peer 和熔断器的状态额外标记出来
+		state := ""
+		if h := p.health[peer]; h != nil && h.isDown() {
+			state = ", Down"
+		}
+		if b := p.breakers[peer]; b != nil {
+			state += fmt.Sprintf(", Breaker: %v", b.current(time.Now()))
+		}
 		// 解析 URL
 		parsedURL, err := url.Parse(peer)
 		if err != nil {
-			output.WriteString(fmt.Sprintf("Peer: %s (invalid URL)\n", peer))
+			output.WriteString(fmt.Sprintf("Peer: %s (invalid URL)%s\n", peer, state))
 			continue
 		}
 		// 提取 host 部分（可能包含端口）
@@ -127,9 +489,9 @@ func (p *HTTPPool) GetPeers() (res string) {
 		ip, port, err := net.SplitHostPort(host)
 		if err != nil {
 			// 如果拆分失败，则直接输出 host
-			output.WriteString(fmt.Sprintf("Peer: %s, Host: %s\n", peer, host))
+			output.WriteString(fmt.Sprintf("Peer: %s, Host: %s%s\n", peer, host, state))
 		} else {
-			output.WriteString(fmt.Sprintf("Peer: %s, IP: %s, Port: %s\n", peer, ip, port))
+			output.WriteString(fmt.Sprintf("Peer: %s, IP: %s, Port: %s%s\n", peer, ip, port, state))
 		}
 	}
 	return output.String()
@@ -137,34 +499,114 @@ func (p *HTTPPool) GetPeers() (res string) {
 
 type httpGetter struct {
 	baseURL string
+	latency *histogram   // may be nil
+	client  *http.Client // nil means http.DefaultClient
+	secret  []byte       // signs requests if set
+	// observe is told whether each request reached the peer, may be nil
+	observe func(ok bool)
+	breaker *breaker // may be nil
 	PeerGetter
 }
 
-func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
-	u := fmt.Sprintf(
+func (h *httpGetter) httpClient() *http.Client {
+	if h.client == nil {
+		return http.DefaultClient
+	}
+	return h.client
+}
+
+func (h *httpGetter) url(in *pb.Request) string {
+	return fmt.Sprintf(
 		"%v%v/%v",
 		h.baseURL,
 		url.QueryEscape(in.GetGroup()),
 		url.QueryEscape(in.GetKey()),
 	)
-	res, err := http.Get(u)
+}
+
+func (h *httpGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	if h.latency != nil {
+		defer h.latency.observeSince(time.Now())
+	}
+	return h.do(ctx, http.MethodGet, h.url(in), nil, out)
+}
+
+func (h *httpGetter) Set(ctx context.Context, in *pb.Request) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("encoding request body: %v", err)
+	}
+	return h.do(ctx, http.MethodPut, h.url(in), body, nil)
+}
+
+func (h *httpGetter) Remove(ctx context.Context, in *pb.Request) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("encoding request body: %v", err)
+	}
+	return h.do(ctx, http.MethodDelete, h.url(in), body, nil)
+}
+
+func (h *httpGetter) GetMulti(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error {
+	if h.latency != nil {
+		defer h.latency.observeSince(time.Now())
+	}
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("encoding request body: %v", err)
+	}
+	return h.do(ctx, http.MethodPost, h.baseURL+batchPath, body, out)
+}
+
+// do sends a request through the peer's circuit breaker and decodes the
+// response body into out, unless out is nil.
+func (h *httpGetter) do(ctx context.Context, method, u string, body []byte, out proto.Message) error {
+	return h.breaker.guard(ctx, func() error {
+		return h.send(ctx, method, u, body, out)
+	})
+}
+
+func (h *httpGetter) send(ctx context.Context, method, u string, body []byte, out proto.Message) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if h.secret != nil {
+		signRequest(req, h.secret, body, time.Now())
+	}
+	res, err := h.httpClient().Do(req)
+	// 调用方自己取消的请求不能算作 peer 的失败
+	if h.observe != nil && ctx.Err() == nil {
+		h.observe(err == nil)
+	}
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned: %v", res.Status)
+		return peerError(res)
 	}
-
-	bytes, err := io.ReadAll(res.Body)
+	if out == nil {
+		return nil
+	}
+	b, err := io.ReadAll(res.Body)
 	if err != nil {
 		return fmt.Errorf("reading response body: %v", err)
 	}
-
-	if err = proto.Unmarshal(bytes, out); err != nil {
+	if err = proto.Unmarshal(b, out); err != nil {
 		return fmt.Errorf("decoding response body: %v", err)
 	}
-
 	return nil
 }
+
+// peerError rebuilds the PeerError behind a non-200 response. Responses
+// without a Status body, e.g. from a proxy, get one from their HTTP status.
+func peerError(res *http.Response) error {
+	b, _ := io.ReadAll(res.Body)
+	msg := &pb.Response{}
+	if proto.Unmarshal(b, msg) == nil && msg.GetStatus() != pb.Status_OK {
+		return &PeerError{Status: msg.GetStatus(), Msg: msg.GetError()}
+	}
+	return &PeerError{Status: statusFromHTTP(res.StatusCode), Msg: strings.TrimSpace(res.Status + " " + string(b))}
+}
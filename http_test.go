@@ -0,0 +1,457 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPSetRemove(t *testing.T) {
+	g := NewGroup("http-set-remove", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	srv := httptest.NewServer(NewHTTPPool("self"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+	ctx := context.Background()
+
+	if err := peer.Set(ctx, &pb.Request{Group: g.name, Key: "Tom", Value: []byte("700")}); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := g.mainCache.get("Tom"); !ok || view.String() != "700" {
+		t.Fatalf("PUT did not populate the cache, got %q", view.String())
+	}
+
+	out := &pb.Response{}
+	if err := peer.Get(ctx, &pb.Request{Group: g.name, Key: "Tom"}, out); err != nil || string(out.GetValue()) != "700" {
+		t.Fatalf("GET = %q, %v, want 700", out.GetValue(), err)
+	}
+
+	if err := peer.Remove(ctx, &pb.Request{Group: g.name, Key: "Tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("DELETE did not remove the key")
+	}
+
+	// a hot key pushed by its owner goes to the hot cache
+	if err := peer.Set(ctx, &pb.Request{Group: g.name, Key: "Jack", Value: []byte("589"), Hot: true}); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := g.hotCache.get("Jack"); !ok || view.String() != "589" {
+		t.Fatalf("hot PUT did not populate the hot cache, got %q", view.String())
+	}
+	if _, ok := g.mainCache.get("Jack"); ok {
+		t.Fatalf("hot PUT populated the main cache")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	g := NewGroup("metrics", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	g.Get("Tom")
+	g.Get("Tom")
+
+	backend := httptest.NewServer(NewHTTPPool("self"))
+	defer backend.Close()
+	pool := NewHTTPPool("self")
+	pool.Set(backend.URL)
+	peer, _ := pool.PickPeer("Tom")
+	peer.Get(context.Background(), &pb.Request{Group: g.name, Key: "Tom"}, &pb.Response{})
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(pool).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`gdcache_gets_total{group="metrics"} 3`,
+		`gdcache_cache_hits_total{group="metrics"} 2`,
+		`gdcache_cache_max_bytes{group="metrics",cache="main"} 2048`,
+		`gdcache_cache_max_bytes{group="metrics",cache="hot"} 256`,
+		`gdcache_ring_nodes 1`,
+		`gdcache_ring_virtual_nodes 50`,
+		`gdcache_peer_request_duration_seconds_count{peer="` + backend.URL + `"} 1`,
+		`gdcache_peer_request_duration_seconds_bucket{peer="` + backend.URL + `",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestHTTPGetMulti(t *testing.T) {
+	g := NewGroup("http-get-multi", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "Sam" {
+				return nil, fmt.Errorf("%s not exist", key)
+			}
+			return []byte("db-" + key), nil
+		}))
+	srv := httptest.NewServer(NewHTTPPool("self"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	out := &pb.BatchResponse{}
+	if err := peer.GetMulti(context.Background(), &pb.BatchRequest{Group: g.name, Keys: []string{"Tom", "Jack", "Sam"}}, out); err != nil {
+		t.Fatal(err)
+	}
+	values := out.GetValues()
+	if len(values) != 3 || string(values["Tom"].GetValue()) != "db-Tom" || string(values["Jack"].GetValue()) != "db-Jack" {
+		t.Fatalf("GetMulti = %v, want Tom, Jack and Sam", values)
+	}
+	if s := values["Sam"].GetStatus(); s != pb.Status_INTERNAL {
+		t.Fatalf("Sam has status %v, want INTERNAL", s)
+	}
+	if n := g.Stats().ServerRequests; n != 3 {
+		t.Fatalf("ServerRequests = %d, want 3", n)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	g := NewGroup("http-errors", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			switch key {
+			case "busy":
+				return nil, fmt.Errorf("db pool exhausted: %w", ErrOverloaded)
+			case "missing":
+				return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+			}
+			return nil, fmt.Errorf("%s broke", key)
+		}))
+	srv := httptest.NewServer(NewHTTPPool("self"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+	ctx := context.Background()
+
+	tests := []struct {
+		group, key string
+		want       pb.Status
+		is         error
+	}{
+		{g.name, "busy", pb.Status_OVERLOADED, ErrOverloaded},
+		{g.name, "broken", pb.Status_INTERNAL, nil},
+		{"no-such-group", "Tom", pb.Status_NO_SUCH_GROUP, ErrNoSuchGroup},
+	}
+	for _, tt := range tests {
+		err := peer.Get(ctx, &pb.Request{Group: tt.group, Key: tt.key}, &pb.Response{})
+		var pe *PeerError
+		if !errors.As(err, &pe) || pe.Status != tt.want {
+			t.Errorf("Get(%s/%s) err = %v, want status %v", tt.group, tt.key, err, tt.want)
+		}
+		if tt.is != nil && !errors.Is(err, tt.is) {
+			t.Errorf("Get(%s/%s) err = %v, want it to match %v", tt.group, tt.key, err, tt.is)
+		}
+	}
+
+	// a missing key is an answer, not an error
+	out := &pb.Response{}
+	if err := peer.Get(ctx, &pb.Request{Group: g.name, Key: "missing"}, out); err != nil || out.GetStatus() != pb.Status_NOT_FOUND {
+		t.Fatalf("Get(missing) = %v, %v, want NOT_FOUND", out.GetStatus(), err)
+	}
+}
+
+func TestHTTPPoolResponseTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	pool := NewHTTPPool("self", WithResponseTimeout(50*time.Millisecond))
+	pool.Set(srv.URL)
+	peer, _ := pool.PickPeer("Tom")
+
+	start := time.Now()
+	err := peer.Get(context.Background(), &pb.Request{Group: "scores", Key: "Tom"}, &pb.Response{})
+	if err == nil {
+		t.Fatalf("Get from a hanging peer succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Get from a hanging peer took %v", d)
+	}
+	if !fallBackLocally(err) {
+		t.Fatalf("a timed out peer should not stop a local load, got %v", err)
+	}
+}
+
+func TestHTTPPoolSharesClient(t *testing.T) {
+	c := &http.Client{Timeout: time.Second}
+	pool := NewHTTPPool("self", WithHTTPClient(c))
+	pool.Set("http://10.0.0.2:8001", "http://10.0.0.3:8001")
+	for _, peer := range pool.AllPeers() {
+		if peer.(*httpGetter).client != c {
+			t.Fatalf("peer %s does not use the pool's client", peer.(*httpGetter).baseURL)
+		}
+	}
+
+	pool = NewHTTPPool("self", WithMaxIdleConnsPerHost(4), WithHTTP2(false))
+	if pool.transport.MaxIdleConnsPerHost != 4 || pool.transport.ForceAttemptHTTP2 {
+		t.Fatalf("options were not applied to the transport")
+	}
+}
+
+func TestHTTPSharedSecret(t *testing.T) {
+	g := NewGroup("http-shared-secret", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	srv := httptest.NewServer(NewHTTPPool("self", WithSharedSecret([]byte("s3cret"))))
+	defer srv.Close()
+	ctx := context.Background()
+	in := &pb.Request{Group: g.name, Key: "Tom"}
+
+	for _, secret := range []string{"", "wrong"} {
+		peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+		if secret != "" {
+			peer.secret = []byte(secret)
+		}
+		var pe *PeerError
+		if err := peer.Get(ctx, in, &pb.Response{}); !errors.As(err, &pe) || pe.Status != pb.Status_UNAUTHENTICATED {
+			t.Fatalf("Get with secret %q err = %v, want UNAUTHENTICATED", secret, err)
+		}
+	}
+
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath, secret: []byte("s3cret")}
+	out := &pb.Response{}
+	if err := peer.Get(ctx, in, out); err != nil || string(out.GetValue()) != "db-Tom" {
+		t.Fatalf("signed Get = %q, %v, want db-Tom", out.GetValue(), err)
+	}
+	if err := peer.Set(ctx, &pb.Request{Group: g.name, Key: "Tom", Value: []byte("700")}); err != nil {
+		t.Fatalf("signed Set: %v", err)
+	}
+}
+
+func TestHTTPMaxRequestBytes(t *testing.T) {
+	g := NewGroup("http-max-request-bytes", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db-" + key), nil
+		}))
+	srv := httptest.NewServer(NewHTTPPool("self", WithMaxRequestBytes(1<<10)))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	in := &pb.Request{Group: g.name, Key: "Tom", Value: []byte(strings.Repeat("7", 2<<10))}
+	var pe *PeerError
+	if err := peer.Set(context.Background(), in); !errors.As(err, &pe) || pe.Status != pb.Status_BAD_REQUEST {
+		t.Fatalf("oversized Set err = %v, want BAD_REQUEST", err)
+	}
+	if err := peer.Set(context.Background(), &pb.Request{Group: g.name, Key: "Tom", Value: []byte("700")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Now()
+	req := httptest.NewRequest(http.MethodPut, "/_mycache/scores/Tom", nil)
+	signRequest(req, secret, []byte("700"), now)
+
+	if _, err := verifyRequest(req, secret, []byte("700"), now); err != nil {
+		t.Fatalf("verifyRequest = %v", err)
+	}
+	if _, err := verifyRequest(req, secret, []byte("999"), now); err == nil {
+		t.Fatalf("a changed body passed verification")
+	}
+	if _, err := verifyRequest(req, secret, []byte("700"), now.Add(2*maxSignatureAge)); err == nil {
+		t.Fatalf("a stale signature passed verification")
+	}
+	other := httptest.NewRequest(http.MethodPut, "/_mycache/scores/Jack", nil)
+	other.Header = req.Header
+	if _, err := verifyRequest(other, secret, []byte("700"), now); err == nil {
+		t.Fatalf("a signature for another key passed verification")
+	}
+}
+
+func TestHTTPRejectsReplayedRequest(t *testing.T) {
+	secret := []byte("s3cret")
+	pool := NewHTTPPool("self", WithSharedSecret(secret))
+	body := []byte("700")
+	req := httptest.NewRequest(http.MethodPut, "/_mycache/scores/Tom", nil)
+	signRequest(req, secret, body, time.Now())
+
+	if err := pool.authenticate(req, body); err != nil {
+		t.Fatalf("authenticate = %v", err)
+	}
+	if err := pool.authenticate(req, body); !errors.Is(err, errUnauthenticated) {
+		t.Fatalf("replayed request: authenticate = %v, want errUnauthenticated", err)
+	}
+	// a new signature of the same request has a new nonce
+	signRequest(req, secret, body, time.Now())
+	if err := pool.authenticate(req, body); err != nil {
+		t.Fatalf("re-signed request: authenticate = %v", err)
+	}
+}
+
+func TestHTTPTLSRequiresClientCert(t *testing.T) {
+	srv := httptest.NewTLSServer(NewHTTPPool("self", WithTLS(&tls.Config{})))
+	defer srv.Close()
+
+	// the test client trusts the server but has no certificate of its own
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath, client: srv.Client()}
+	var pe *PeerError
+	if err := peer.Get(context.Background(), &pb.Request{Group: "scores", Key: "Tom"}, &pb.Response{}); !errors.As(err, &pe) || pe.Status != pb.Status_UNAUTHENTICATED {
+		t.Fatalf("Get without a client certificate err = %v, want UNAUTHENTICATED", err)
+	}
+}
+
+func TestHTTPPoolEjectsUnhealthyPeers(t *testing.T) {
+	var wedged atomic.Bool
+	wedged.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wedged.Load() {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	pool := NewHTTPPool("self", WithResponseTimeout(20*time.Millisecond), WithHealthCheck(30*time.Millisecond, 2, 1))
+	pool.Set(srv.URL)
+	peer, ok := pool.PickPeer("Tom")
+	if !ok {
+		t.Fatalf("PickPeer did not pick the only peer")
+	}
+	for i := 0; i < 2; i++ {
+		peer.Get(context.Background(), &pb.Request{Group: "scores", Key: "Tom"}, &pb.Response{})
+	}
+	if _, ok := pool.PickPeer("Tom"); ok {
+		t.Fatalf("a peer that failed twice is still picked")
+	}
+	if !strings.Contains(pool.GetPeers(), "Down") {
+		t.Fatalf("GetPeers does not show the peer as down:\n%s", pool.GetPeers())
+	}
+	var metrics strings.Builder
+	pool.writeMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "gdcache_ring_nodes 0\n") {
+		t.Fatalf("metrics count the ejected peer on the ring:\n%s", metrics.String())
+	}
+
+	// once probes succeed again the peer is put back on the ring
+	wedged.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := pool.PickPeer("Tom"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a recovered peer was not reinstated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPHealthEndpoint(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPPool("self", WithSharedSecret([]byte("s3cret"))))
+	defer srv.Close()
+
+	// probes need no signature
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+	if err := peer.probe(context.Background()); err != nil {
+		t.Fatalf("probe = %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(BreakerConfig{MinRequests: 4, ErrorRate: 0.5, SlowCall: time.Second, CoolDown: time.Minute})
+	now := time.Now()
+	allowed := func(at time.Time) bool {
+		_, ok := b.allow(at)
+		return ok
+	}
+
+	// a failure before MinRequests does not open the breaker
+	gen, _ := b.allow(now)
+	b.done(now, gen, true, 0)
+	b.done(now, gen, false, 0)
+	b.done(now, gen, true, 0)
+	if s := b.current(now); s != breakerClosed {
+		t.Fatalf("state = %v after 2 of 3 failed, want closed", s)
+	}
+	b.done(now, gen, false, 0)
+	if s := b.current(now); s != breakerOpen || allowed(now) {
+		t.Fatalf("state = %v after 2 of 4 failed, want open", s)
+	}
+
+	// after the cool-down a single trial goes through, and requests let
+	// through while the breaker was closed do not decide it
+	later := now.Add(time.Minute)
+	trial, ok := b.allow(later)
+	if !ok || allowed(later) {
+		t.Fatalf("half-open breaker should let exactly one trial through")
+	}
+	b.done(later, gen, false, 0)
+	if s := b.current(later); s != breakerHalfOpen || allowed(later) {
+		t.Fatalf("state = %v after a stale success, want half-open with the trial in flight", s)
+	}
+	// a trial the caller gave up on lets the next request be the trial
+	b.cancel(trial)
+	if trial, ok = b.allow(later); !ok {
+		t.Fatalf("half-open breaker rejected the trial after a cancelled one")
+	}
+	b.done(later, trial, false, 2*time.Second)
+	if s := b.current(later); s != breakerOpen {
+		t.Fatalf("state = %v after a slow trial, want open", s)
+	}
+	later = later.Add(time.Minute)
+	if trial, ok = b.allow(later); !ok {
+		t.Fatalf("half-open breaker rejected the trial")
+	}
+	b.done(later, trial, false, 0)
+	if s := b.current(later); s != breakerClosed || !allowed(later) {
+		t.Fatalf("state = %v after a good trial, want closed", s)
+	}
+}
+
+func TestHTTPPoolCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		writeError(w, pb.Status_INTERNAL, "db is down")
+	}))
+	defer srv.Close()
+
+	pool := NewHTTPPool("self", WithHealthCheck(0, 0, 0),
+		WithCircuitBreaker(&BreakerConfig{MinRequests: 2, CoolDown: time.Minute}))
+	pool.Set(srv.URL)
+	peer, _ := pool.PickPeer("Tom")
+	for i := 0; i < 2; i++ {
+		peer.Get(context.Background(), &pb.Request{Group: "scores", Key: "Tom"}, &pb.Response{})
+	}
+	err := peer.Get(context.Background(), &pb.Request{Group: "scores", Key: "Tom"}, &pb.Response{})
+	if !errors.Is(err, ErrCircuitOpen) || requests.Load() != 2 {
+		t.Fatalf("Get err = %v after %d requests, want ErrCircuitOpen after 2", err, requests.Load())
+	}
+	if !fallBackLocally(err) {
+		t.Fatalf("an open breaker should let the Group load locally")
+	}
+	if !strings.Contains(pool.GetPeers(), "Breaker: open") {
+		t.Fatalf("GetPeers does not show the open breaker:\n%s", pool.GetPeers())
+	}
+}
+
+func TestHTTPPoolPicksOwnerWithOpenBreaker(t *testing.T) {
+	pool := NewHTTPPool("self", WithHealthCheck(0, 0, 0))
+	pool.Set("http://10.0.0.2:8001", "http://10.0.0.3:8001")
+	order := pool.peers.GetN("Tom", 2)
+	if n := len(pool.PickReplicas("Tom", 2)); n != 2 {
+		t.Fatalf("PickReplicas returned %d peers, want 2", n)
+	}
+
+	// the Group, not the pool, decides where a key goes when its owner's
+	// breaker is open
+	pool.breakers[order[0]].open(time.Now())
+	peer, ok := pool.PickPeer("Tom")
+	if !ok || peer.(*httpGetter).baseURL != order[0]+defaultBasePath {
+		t.Fatalf("PickPeer with the owner's breaker open = %v, want %s", peer, order[0])
+	}
+}
@@ -2,12 +2,25 @@ package main
 
 import (
 	"GoDistributedCache"
+	"GoDistributedCache/diskcache"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var db = map[string]string{
@@ -16,53 +29,117 @@ var db = map[string]string{
 	"Sam":  "567",
 }
 
-func createGroup() *GoDistributedCache.Group {
+func createGroup(opts ...GoDistributedCache.GroupOption) *GoDistributedCache.Group {
+	opts = append([]GoDistributedCache.GroupOption{GoDistributedCache.WithHotKeyReplication(time.Minute, 10, 100)}, opts...)
 	return GoDistributedCache.NewGroup("scores", 2<<10, GoDistributedCache.GetterFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[SlowDB] search key", key)
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
-		}))
+			return nil, fmt.Errorf("%s: %w", key, GoDistributedCache.ErrNotFound)
+		}), opts...)
 }
 
-func startCacheServer(addr string, dnsServiceName string, gee *GoDistributedCache.Group) {
-	peers := GoDistributedCache.NewHTTPPool(addr)
-	gee.RegisterPeers(peers)
+// watchPeers 定时查询 DNS 动态更新 peers 列表，addrFormat 把 IP 转成 peer 地址
+func watchPeers(dnsServiceName string, addrFormat string, set func(peers ...string)) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		ips, err := net.LookupHost(dnsServiceName)
+		if err != nil {
+			log.Printf("DNS lookup error for %s: %v", dnsServiceName, err)
+			continue
+		}
+		var dynamicAddrs []string
+		// 假设所有节点都在同一个端口，例如 8001
+		for _, ip := range ips {
+			peerAddr := fmt.Sprintf(addrFormat, ip)
+			dynamicAddrs = append(dynamicAddrs, peerAddr)
+		}
+		set(dynamicAddrs...)
+		log.Printf("Updated peers: %v", dynamicAddrs)
+	}
+}
+
+// startCacheServer 在 tlsConfig 不为 nil 时通过 https 提供服务，并要求 peer 出示客户端证书
+func startCacheServer(addr string, dnsServiceName string, peers *GoDistributedCache.HTTPPool, tlsConfig *tls.Config) {
 	log.Println("GoDistributedCache is running at", addr)
 
-	// 定时查询 DNS 动态更新 peers 列表
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			<-ticker.C
-			ips, err := net.LookupHost(dnsServiceName)
-			if err != nil {
-				log.Printf("DNS lookup error for %s: %v", dnsServiceName, err)
-				continue
-			}
-			var dynamicAddrs []string
-			// 假设所有节点都在同一个端口，例如 8001
-			for _, ip := range ips {
-				peerAddr := fmt.Sprintf("http://%s:8001", ip)
-				dynamicAddrs = append(dynamicAddrs, peerAddr)
-			}
-			peers.Set(dynamicAddrs...)
-			log.Printf("Updated peers: %v", dynamicAddrs)
-		}
-	}()
+	scheme := "http://"
+	if tlsConfig != nil {
+		scheme = "https://"
+	}
+	go watchPeers(dnsServiceName, scheme+"%s:8001", peers.Set)
 
-	// addr[7:] 去掉 "http://" 前缀，作为监听地址
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	// 去掉 scheme 前缀，作为监听地址
+	server := &http.Server{Addr: strings.TrimPrefix(addr, scheme), Handler: peers, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
-func startAPIServer(apiAddr string, gee *GoDistributedCache.Group) {
+// startGRPCCacheServer 与 startCacheServer 相同，但 peer 之间使用 gRPC 长连接通信，addr 不带 scheme
+func startGRPCCacheServer(addr string, dnsServiceName string, peers *GoDistributedCache.GRPCPool, tlsConfig *tls.Config) {
+	log.Println("GoDistributedCache (gRPC) is running at", addr)
+
+	go watchPeers(dnsServiceName, "%s:8001", peers.Set)
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var serverOpts []grpc.ServerOption
+	if tlsConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(serverOpts...)
+	peers.Register(server)
+	log.Fatal(server.Serve(lis))
+}
+
+func startAPIServer(apiAddr string, gee *GoDistributedCache.Group, peers GoDistributedCache.PeerPicker) {
 	http.Handle("/api", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
-			view, err := gee.Get(key)
+			switch r.Method {
+			case http.MethodPut:
+				// PUT 写入新值，DELETE 让所有节点上的副本失效
+				value, err := io.ReadAll(r.Body)
+				if err == nil {
+					err = gee.Set(key, value)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			case http.MethodDelete:
+				if err := gee.Invalidate(key); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			// 多个 key（/api?key=a&key=b）一次批量获取，以 JSON 返回取到的值
+			if keys := r.URL.Query()["key"]; len(keys) > 1 {
+				values, err := gee.GetMultiContext(r.Context(), keys)
+				if err != nil {
+					log.Println("GetMulti:", err)
+				}
+				res := make(map[string]string, len(values))
+				for k, v := range values {
+					res[k] = v.String()
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			view, err := gee.GetContext(r.Context(), key)
+			if errors.Is(err, GoDistributedCache.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -76,19 +153,186 @@ func startAPIServer(apiAddr string, gee *GoDistributedCache.Group) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte(output))
 	}))
+	// /stats 输出 Group 和缓存的统计信息，用于监控命中率
+	http.Handle("/stats", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Group     GoDistributedCache.Stats
+			MainCache GoDistributedCache.CacheStats
+			HotCache  GoDistributedCache.CacheStats
+		}{gee.Stats(), gee.CacheStats(GoDistributedCache.MainCache), gee.CacheStats(GoDistributedCache.HotCache)})
+	}))
+	// /metrics 以 Prometheus 文本格式输出指标
+	http.Handle("/metrics", GoDistributedCache.MetricsHandler(peers))
 	log.Println("fontend server is running at", apiAddr)
 	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
 }
 
+// claimSnapshot 找一个可以恢复的快照：优先本 Pod 之前留下的（容器重启），
+// 否则接管同一节点上已退出的 Pod 留下的最新的一个（滚动更新后名字会变）。
+// rename 是原子的，同一节点上同时启动的 Pod 不会拿到同一个快照
+func claimSnapshot(dir, pod string) (string, bool) {
+	claimed := filepath.Join(dir, pod+".restoring")
+	candidates := []string{filepath.Join(dir, pod+".snapshot")}
+	others, _ := filepath.Glob(filepath.Join(dir, "*.snapshot"))
+	sort.Slice(others, func(i, j int) bool {
+		return modTime(others[i]).After(modTime(others[j]))
+	})
+	for _, path := range append(candidates, others...) {
+		if os.Rename(path, claimed) == nil {
+			return claimed, true
+		}
+	}
+	return "", false
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// restoreSnapshot 启动时从快照恢复缓存内容，避免滚动更新后冷启动击穿数据库。
+// 恢复后删除快照，免得再被别的 Pod 接管
+func restoreSnapshot(path string, gee *GoDistributedCache.Group) {
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("open snapshot %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+	if err := gee.Restore(f); err != nil {
+		log.Printf("restore snapshot %s: %v", path, err)
+		return
+	}
+	log.Printf("restored %d entries from %s", gee.CacheStats(GoDistributedCache.MainCache).Items, path)
+}
+
+// saveSnapshot 先写临时文件再 rename，进程中途被杀也不会留下半个快照
+func saveSnapshot(path string, gee *GoDistributedCache.Group) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = gee.Snapshot(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotOnSIGTERM 收到 SIGTERM（k8s 停止 Pod）时保存快照后退出
+func snapshotOnSIGTERM(path string, gee *GoDistributedCache.Group) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sig
+		if err := saveSnapshot(path, gee); err != nil {
+			log.Printf("save snapshot %s: %v", path, err)
+			os.Exit(1)
+		}
+		log.Printf("saved snapshot to %s", path)
+		os.Exit(0)
+	}()
+}
+
 func main() {
 	apiAddr := "http://0.0.0.0:9999"
-	gee := createGroup()
-	go startAPIServer(apiAddr, gee)
+
+	// CACHE_DISK_DIR 配置后，内存中被淘汰的条目写入本地磁盘作为二级缓存
+	var opts []GoDistributedCache.GroupOption
+	if dir := os.Getenv("CACHE_DISK_DIR"); dir != "" {
+		store, err := diskcache.Open(filepath.Join(dir, "scores.l2"), 1<<30)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, GoDistributedCache.WithDiskCache(store))
+	}
+	// 快照超过 CACHE_SNAPSHOT_MAX_AGE（默认 10 分钟）就不再恢复，main 的 group 没有 TTL，
+	// 旧快照里的值会一直被当作有效值返回
+	maxAge := 10 * time.Minute
+	if v := os.Getenv("CACHE_SNAPSHOT_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		maxAge = d
+	}
+	opts = append(opts, GoDistributedCache.WithSnapshotMaxAge(maxAge))
+	gee := createGroup(opts...)
+
+	// CACHE_SNAPSHOT_DIR 配置后，启动时恢复快照，退出时保存快照。
+	// 同一节点上的 Pod 共用这个目录，所以快照文件按 Pod 名区分
+	if dir := os.Getenv("CACHE_SNAPSHOT_DIR"); dir != "" {
+		pod := os.Getenv("MY_POD_NAME")
+		if pod == "" {
+			pod, _ = os.Hostname()
+		}
+		if path, ok := claimSnapshot(dir, pod); ok {
+			restoreSnapshot(path, gee)
+		}
+		snapshotOnSIGTERM(filepath.Join(dir, pod+".snapshot"), gee)
+	}
 
 	// 假设使用 DNS 服务发现的域名，需在 k8s 中配置好 Headless Service
 	dnsServiceName := "mycache-headless.default.svc.cluster.local"
 	podIP := os.Getenv("MY_POD_IP")
-	selfAddr := fmt.Sprintf("http://%s:8001", podIP)
 
-	startCacheServer(selfAddr, dnsServiceName, gee)
+	// CACHE_TLS_CERT/KEY/CA 配置后 peer 之间使用双向 TLS，CACHE_PEER_SECRET 配置后请求带 HMAC 签名
+	var tlsConfig *tls.Config
+	if cert := os.Getenv("CACHE_TLS_CERT"); cert != "" {
+		var err error
+		// Pod IP 会变，证书按 Headless Service 的域名校验，可用 CACHE_TLS_SERVER_NAME 覆盖
+		serverName := os.Getenv("CACHE_TLS_SERVER_NAME")
+		if serverName == "" {
+			serverName = dnsServiceName
+		}
+		tlsConfig, err = GoDistributedCache.NewMutualTLSConfig(cert, os.Getenv("CACHE_TLS_KEY"), os.Getenv("CACHE_TLS_CA"), serverName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	secret := os.Getenv("CACHE_PEER_SECRET")
+
+	// CACHE_TRANSPORT=grpc 时 peer 之间使用 gRPC，默认使用 HTTP
+	if os.Getenv("CACHE_TRANSPORT") == "grpc" {
+		// HMAC 签名只有 HTTP 支持，不能悄悄退回到不认证
+		if secret != "" {
+			log.Fatal("CACHE_PEER_SECRET is not supported with CACHE_TRANSPORT=grpc, use CACHE_TLS_CERT/KEY/CA")
+		}
+		var poolOpts []GoDistributedCache.GRPCPoolOption
+		if tlsConfig != nil {
+			poolOpts = append(poolOpts, GoDistributedCache.WithGRPCTLS(tlsConfig))
+		}
+		selfAddr := fmt.Sprintf("%s:8001", podIP)
+		peers := GoDistributedCache.NewGRPCPool(selfAddr, poolOpts...)
+		gee.RegisterPeers(peers)
+		go startAPIServer(apiAddr, gee, peers)
+		startGRPCCacheServer(selfAddr, dnsServiceName, peers, tlsConfig)
+		return
+	}
+	var poolOpts []GoDistributedCache.HTTPPoolOption
+	scheme := "http"
+	if tlsConfig != nil {
+		poolOpts = append(poolOpts, GoDistributedCache.WithTLS(tlsConfig))
+		scheme = "https"
+	}
+	if secret != "" {
+		poolOpts = append(poolOpts, GoDistributedCache.WithSharedSecret([]byte(secret)))
+	}
+	selfAddr := fmt.Sprintf("%s://%s:8001", scheme, podIP)
+	peers := GoDistributedCache.NewHTTPPool(selfAddr, poolOpts...)
+	gee.RegisterPeers(peers)
+	go startAPIServer(apiAddr, gee, peers)
+	startCacheServer(selfAddr, dnsServiceName, peers, tlsConfig)
 }
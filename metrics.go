@@ -0,0 +1,173 @@
+package GoDistributedCache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// peerLatencyBuckets are the upper bounds, in seconds, of the peer request
+// latency histograms.
+var peerLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// histogram is a cumulative histogram in the shape Prometheus expects.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // counts[i] observations <= bounds[i], the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+// write writes the histogram's series, labels being e.g. `peer="x",`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	cum += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, cum)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, trimComma(labels), h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, trimComma(labels), h.count)
+}
+
+func trimComma(labels string) string {
+	if n := len(labels); n > 0 && labels[n-1] == ',' {
+		return labels[:n-1]
+	}
+	return labels
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// metricsWriter is implemented by the peer pools that can report their own
+// metrics next to the Groups'.
+type metricsWriter interface {
+	writeMetrics(w io.Writer)
+}
+
+// MetricsHandler serves the statistics of every Group, and those of peers
+// if it reports any, in the Prometheus text exposition format.
+func MetricsHandler(peers PeerPicker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeGroupMetrics(w)
+		if mw, ok := peers.(metricsWriter); ok {
+			mw.writeMetrics(w)
+		}
+	})
+}
+
+func writeGroupMetrics(w io.Writer) {
+	mu.RLock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	stats := make([]Stats, len(all))
+	for i, g := range all {
+		stats[i] = g.Stats()
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(i int) int64
+	}{
+		{"gdcache_gets_total", "Get requests, including those from peers.", func(i int) int64 { return stats[i].Gets }},
+		{"gdcache_cache_hits_total", "Gets served straight from the cache.", func(i int) int64 { return stats[i].CacheHits }},
+		{"gdcache_loads_total", "Gets that missed the cache.", func(i int) int64 { return stats[i].Loads }},
+		{"gdcache_disk_hits_total", "Loads served from the disk tier.", func(i int) int64 { return stats[i].DiskHits }},
+		{"gdcache_loads_run_total", "Loads that ran after singleflight deduplication.", func(i int) int64 { return stats[i].LoadsRun }},
+		{"gdcache_peer_loads_total", "Values fetched from the owning peer.", func(i int) int64 { return stats[i].PeerLoads }},
+		{"gdcache_peer_errors_total", "Failed fetches from the owning peer.", func(i int) int64 { return stats[i].PeerErrors }},
+		{"gdcache_peer_retries_total", "Peer requests sent again after a transport error.", func(i int) int64 { return stats[i].PeerRetries }},
+		{"gdcache_peer_hedges_total", "Peer fetches slow enough to race a local load.", func(i int) int64 { return stats[i].PeerHedges }},
+		{"gdcache_hedge_wins_total", "Hedged local loads that answered before the peer.", func(i int) int64 { return stats[i].HedgeWins }},
+		{"gdcache_local_loads_total", "Values loaded by this node's Getter.", func(i int) int64 { return stats[i].LocalLoads }},
+		{"gdcache_local_load_errors_total", "Failed loads by this node's Getter.", func(i int) int64 { return stats[i].LocalLoadErrs }},
+		{"gdcache_server_requests_total", "Gets that came over the network from peers.", func(i int) int64 { return stats[i].ServerRequests }},
+	}
+	for _, c := range counters {
+		writeHeader(w, c.name, "counter", c.help)
+		for i, g := range all {
+			fmt.Fprintf(w, "%s{group=%q} %d\n", c.name, g.name, c.value(i))
+		}
+	}
+
+	tiers := []struct {
+		label string
+		which CacheType
+	}{{"main", MainCache}, {"hot", HotCache}, {"negative", NegativeCache}}
+	cacheStats := make([][]CacheStats, len(all))
+	for i, g := range all {
+		for _, tier := range tiers {
+			cacheStats[i] = append(cacheStats[i], g.CacheStats(tier.which))
+		}
+	}
+	perCache := []struct {
+		name, typ, help string
+		value           func(s CacheStats) int64
+	}{
+		{"gdcache_cache_gets_total", "counter", "Lookups in the cache.", func(s CacheStats) int64 { return s.Gets }},
+		{"gdcache_cache_get_hits_total", "counter", "Lookups that found the key in the cache.", func(s CacheStats) int64 { return s.Hits }},
+		{"gdcache_cache_evictions_total", "counter", "Entries evicted to stay within the byte budget.", func(s CacheStats) int64 { return s.Evictions }},
+		{"gdcache_cache_bytes", "gauge", "Bytes of keys and values held in the cache.", func(s CacheStats) int64 { return s.Bytes }},
+		{"gdcache_cache_max_bytes", "gauge", "Byte budget of the cache, 0 if unlimited.", func(s CacheStats) int64 { return s.MaxBytes }},
+		{"gdcache_cache_items", "gauge", "Entries held in the cache.", func(s CacheStats) int64 { return s.Items }},
+	}
+	for _, c := range perCache {
+		writeHeader(w, c.name, c.typ, c.help)
+		for i, g := range all {
+			for j, tier := range tiers {
+				fmt.Fprintf(w, "%s{group=%q,cache=%q} %d\n", c.name, g.name, tier.label, c.value(cacheStats[i][j]))
+			}
+		}
+	}
+}
+
+// writePeerMetrics writes the metrics shared by HTTPPool and GRPCPool.
+func writePeerMetrics(w io.Writer, nodes, virtualNodes int, latencies map[string]*histogram) {
+	writeHeader(w, "gdcache_ring_nodes", "gauge", "Peers on the consistent hash ring.")
+	fmt.Fprintf(w, "gdcache_ring_nodes %d\n", nodes)
+	writeHeader(w, "gdcache_ring_virtual_nodes", "gauge", "Virtual nodes on the consistent hash ring.")
+	fmt.Fprintf(w, "gdcache_ring_virtual_nodes %d\n", virtualNodes)
+
+	peers := make([]string, 0, len(latencies))
+	for peer := range latencies {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	writeHeader(w, "gdcache_peer_request_duration_seconds", "histogram", "Latency of Get requests sent to peers.")
+	for _, peer := range peers {
+		latencies[peer].write(w, "gdcache_peer_request_duration_seconds", fmt.Sprintf("peer=%q,", peer))
+	}
+}
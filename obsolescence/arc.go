@@ -0,0 +1,209 @@
+package obsolescence
+
+import "container/list"
+
+// lists of an ARCCache
+const (
+	arcT1 = iota // resident, seen once recently
+	arcT2        // resident, seen at least twice recently
+	arcB1        // ghosts evicted from T1
+	arcB2        // ghosts evicted from T2
+)
+
+// ARCCache is an Adaptive Replacement Cache. Resident entries are split
+// between T1 (recency) and T2 (frequency), and the keys recently evicted
+// from each are remembered in the ghost lists B1 and B2. A miss that hits
+// B1 means T1 was too small and grows its target share p, a miss that hits
+// B2 shrinks it, so the cache follows workloads that swing between
+// recency-heavy and frequency-heavy phases.
+// Sizes are accounted in bytes like the other caches here, ghosts included.
+// It is not safe for concurrent access.
+type ARCCache struct {
+	maxBytes int64
+	p        int64 // target bytes of T1
+
+	lists [4]*list.List // most recently used at the front
+	bytes [4]int64
+	cache map[string]*list.Element // resident and ghost entries
+
+	OnEvicted func(key string, value Value) // optional and executed when a resident entry is purged.
+}
+
+type arcEntry struct {
+	key   string
+	value Value // nil for ghosts
+	size  int64
+	list  int
+}
+
+// NewARCCache is the Constructor of ARCCache
+func NewARCCache(maxBytes int64, onEvicted func(string, Value)) *ARCCache {
+	c := &ARCCache{
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*list.Element),
+		OnEvicted: onEvicted,
+	}
+	for i := range c.lists {
+		c.lists[i] = list.New()
+	}
+	return c
+}
+
+// Get look ups a key's value, moving it to T2
+func (c *ARCCache) Get(key string) (value Value, ok bool) {
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	kv := ele.Value.(*arcEntry)
+	if kv.list == arcB1 || kv.list == arcB2 {
+		return nil, false
+	}
+	c.move(ele, arcT2)
+	return kv.value, true
+}
+
+// Add adds a value to the cache. A key found in a ghost list adapts p
+// before it comes back as a frequent entry.
+func (c *ARCCache) Add(key string, value Value) {
+	size := int64(len(key)) + int64(value.Len())
+	ele, ok := c.cache[key]
+	if !ok {
+		c.trimGhosts(size)
+		kv := &arcEntry{key: key, value: value, size: size, list: arcT1}
+		c.cache[key] = c.lists[arcT1].PushFront(kv)
+		c.bytes[arcT1] += size
+		c.replace(false)
+		return
+	}
+
+	kv := ele.Value.(*arcEntry)
+	inB2 := kv.list == arcB2
+	switch kv.list {
+	case arcB1:
+		c.p = min(c.p+c.delta(arcB2, arcB1, size), c.maxBytes)
+	case arcB2:
+		c.p = max(c.p-c.delta(arcB1, arcB2, size), 0)
+	}
+	c.bytes[kv.list] -= kv.size
+	kv.value, kv.size = value, size
+	c.bytes[kv.list] += kv.size
+	c.move(ele, arcT2)
+	c.replace(inB2)
+}
+
+// delta is how far a ghost hit in list hit moves p: by the entry's size,
+// scaled up when the other ghost list is the bigger one.
+func (c *ARCCache) delta(other, hit int, size int64) int64 {
+	if c.bytes[hit] == 0 || c.bytes[other] <= c.bytes[hit] {
+		return size
+	}
+	return size * (c.bytes[other] / c.bytes[hit])
+}
+
+// move moves ele to the front of list l.
+func (c *ARCCache) move(ele *list.Element, l int) {
+	kv := ele.Value.(*arcEntry)
+	c.lists[kv.list].Remove(ele)
+	c.bytes[kv.list] -= kv.size
+	kv.list = l
+	c.cache[kv.key] = c.lists[l].PushFront(kv)
+	c.bytes[l] += kv.size
+}
+
+// replace evicts resident entries into the ghost lists until T1 and T2 fit
+// in maxBytes, taking from T1 while it is above its target p.
+func (c *ARCCache) replace(inB2 bool) {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.bytes[arcT1]+c.bytes[arcT2] > c.maxBytes {
+		t1 := c.bytes[arcT1]
+		if t1 > 0 && (t1 > c.p || (inB2 && t1 == c.p) || c.lists[arcT2].Len() == 0) {
+			c.evict(arcT1, arcB1)
+		} else {
+			c.evict(arcT2, arcB2)
+		}
+	}
+	c.trimGhosts(0)
+}
+
+// trimGhosts drops the oldest ghosts so that, with extra more bytes coming
+// into T1, T1+B1 stays within maxBytes and all lists within twice that.
+func (c *ARCCache) trimGhosts(extra int64) {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.lists[arcB1].Len() > 0 && c.bytes[arcT1]+c.bytes[arcB1]+extra > c.maxBytes {
+		c.drop(c.lists[arcB1].Back())
+	}
+	for c.lists[arcB2].Len() > 0 && c.Bytes()+c.bytes[arcB1]+c.bytes[arcB2]+extra > 2*c.maxBytes {
+		c.drop(c.lists[arcB2].Back())
+	}
+}
+
+// evict turns the least recently used entry of resident list from into a
+// ghost at the front of ghost list to.
+func (c *ARCCache) evict(from, to int) {
+	ele := c.lists[from].Back()
+	kv := ele.Value.(*arcEntry)
+	value := kv.value
+	kv.value = nil
+	c.move(ele, to)
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, value)
+	}
+}
+
+// drop forgets ele entirely.
+func (c *ARCCache) drop(ele *list.Element) {
+	kv := ele.Value.(*arcEntry)
+	c.lists[kv.list].Remove(ele)
+	c.bytes[kv.list] -= kv.size
+	delete(c.cache, kv.key)
+}
+
+// RemoveOldest evicts the entry ARC would replace next
+func (c *ARCCache) RemoveOldest() {
+	t1 := c.bytes[arcT1]
+	if t1 > 0 && (t1 > c.p || c.lists[arcT2].Len() == 0) {
+		c.evict(arcT1, arcB1)
+	} else if c.lists[arcT2].Len() > 0 {
+		c.evict(arcT2, arcB2)
+	}
+}
+
+// Del removes key from the cache, forgetting its ghost too
+func (c *ARCCache) Del(key string) {
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	kv := ele.Value.(*arcEntry)
+	value := kv.value
+	c.drop(ele)
+	if value != nil && c.OnEvicted != nil {
+		c.OnEvicted(kv.key, value)
+	}
+}
+
+// Bytes returns the memory taken by resident keys and values
+func (c *ARCCache) Bytes() int64 {
+	return c.bytes[arcT1] + c.bytes[arcT2]
+}
+
+// Len the number of resident cache entries
+func (c *ARCCache) Len() int {
+	return c.lists[arcT1].Len() + c.lists[arcT2].Len()
+}
+
+// Walk calls fn for every resident entry, T1 then T2, each least recently
+// used first
+func (c *ARCCache) Walk(fn func(key string, value Value)) {
+	for _, l := range []int{arcT1, arcT2} {
+		for ele := c.lists[l].Back(); ele != nil; ele = ele.Prev() {
+			kv := ele.Value.(*arcEntry)
+			fn(kv.key, kv.value)
+		}
+	}
+}
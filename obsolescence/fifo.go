@@ -35,10 +35,10 @@ func (c *FIFOCache) Get(key string) (value Value, ok bool) {
 
 func (c *FIFOCache) Add(key string, value Value) {
 	if ele, ok := c.cache[key]; ok {
+		// 更新值不改变进入队列的顺序
 		kv := ele.Value.(*fifoEntry)
+		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
-		c.ll.MoveToFront(ele)
-		c.computeBytes(true, kv)
 	} else {
 		kv := &fifoEntry{key, value}
 		ele := c.ll.PushFront(kv)
@@ -57,6 +57,9 @@ func (c *FIFOCache) RemoveOldest() {
 		kv := ele.Value.(*fifoEntry)
 		delete(c.cache, kv.key)
 		c.computeBytes(false, kv) // 减少内存
+		if c.OnEvicted != nil {
+			c.OnEvicted(kv.key, kv.value)
+		}
 	}
 }
 
@@ -66,16 +69,33 @@ func (c *FIFOCache) Del(key string) {
 		kv := ele.Value.(*fifoEntry)
 		delete(c.cache, kv.key)
 		c.computeBytes(false, kv)
+		if c.OnEvicted != nil {
+			c.OnEvicted(kv.key, kv.value)
+		}
 	}
 }
 
 func (c *FIFOCache) computeBytes(isSum bool, kv *fifoEntry) {
 	if isSum {
 		c.nBytes += int64(len(kv.key)) + int64(kv.value.Len())
+	} else {
+		c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
 	}
-	c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+}
+
+// Bytes returns the memory taken by keys and values in the cache
+func (c *FIFOCache) Bytes() int64 {
+	return c.nBytes
 }
 
 func (c *FIFOCache) Len() int {
 	return c.ll.Len()
 }
+
+// Walk calls fn for every entry, first added first
+func (c *FIFOCache) Walk(fn func(key string, value Value)) {
+	for ele := c.ll.Back(); ele != nil; ele = ele.Prev() {
+		kv := ele.Value.(*fifoEntry)
+		fn(kv.key, kv.value)
+	}
+}
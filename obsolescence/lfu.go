@@ -2,83 +2,174 @@ package obsolescence
 
 import "container/list"
 
-// LFUCache Cache is LRU cache. It is not safe for concurrent access.
+// LFUCache Cache is LFU cache. Get, Add and eviction are O(1), entries of
+// equal frequency are evicted least recently used first.
+// It is not safe for concurrent access.
 type LFUCache struct {
 	maxBytes int64                    // max memory
 	nBytes   int64                    // current memory
-	ll       *list.List               // double linked list
-	cache    map[string]*list.Element // map
+	buckets  *list.List               // lfuBuckets by ascending freq, the front one is evicted from
+	cache    map[string]*list.Element // key -> element of its bucket's entries
 
-	OnEvicted func(key string, value Value) // optional and executed when an lruEntry is purged.
+	// AgeEvery, if not zero, halves every frequency after that many Gets
+	// and Adds, so keys that were hot long ago can still age out.
+	AgeEvery int
+	ops      int
+
+	OnEvicted func(key string, value Value) // optional and executed when an lfuEntry is purged.
+}
+
+// lfuBucket holds the entries sharing a frequency, most recently used first.
+type lfuBucket struct {
+	freq    int
+	entries *list.List
 }
 
 type lfuEntry struct {
-	key   string
-	value Value
-	freq  int
+	key    string
+	value  Value
+	bucket *list.Element // element of LFUCache.buckets holding this entry
 }
 
 // NewLFUCache is the Constructor of NewLFUCache
 func NewLFUCache(maxBytes int64, onEvicted func(string, Value)) *LFUCache {
 	return &LFUCache{
 		maxBytes:  maxBytes,
-		ll:        list.New(),
+		buckets:   list.New(),
 		cache:     make(map[string]*list.Element),
 		OnEvicted: onEvicted,
 	}
 }
 
+// Get look ups a key's value and counts the access
 func (c *LFUCache) Get(key string) (value Value, ok bool) {
 	if ele, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*lfuEntry)
-		kv.freq++
+		c.touch(ele)
+		c.age()
 		return kv.value, true
 	}
 	return
 }
 
+// Add adds a value to the cache, counting it as an access if the key exists.
 func (c *LFUCache) Add(key string, value Value) {
 	if ele, ok := c.cache[key]; ok {
 		kv := ele.Value.(*lfuEntry)
+		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
-		c.ll.MoveToFront(ele)
-		kv.freq++
-		c.nBytes += int64(value.Len())
-		c.computeBytes(true, kv)
+		c.touch(ele)
 	} else {
-		kv := &lfuEntry{key, value, 1}
-		ele := c.ll.PushFront(kv)
-		c.cache[key] = ele
-		c.nBytes += int64(len(key) + value.Len())
-		c.computeBytes(true, kv)
+		front := c.buckets.Front()
+		if front == nil || front.Value.(*lfuBucket).freq != 1 {
+			front = c.buckets.PushFront(&lfuBucket{freq: 1, entries: list.New()})
+		}
+		kv := &lfuEntry{key: key, value: value, bucket: front}
+		c.cache[key] = front.Value.(*lfuBucket).entries.PushFront(kv)
+		c.nBytes += int64(len(key)) + int64(value.Len())
+	}
+	c.age()
+	for c.maxBytes != 0 && c.nBytes > c.maxBytes {
+		c.RemoveOldest()
 	}
 }
 
-func (c *LFUCache) computeBytes(isSum bool, kv *lfuEntry) {
-	if isSum {
-		c.nBytes += int64(len(kv.key)) + int64(kv.value.Len())
+// touch moves ele to the bucket of the next frequency.
+func (c *LFUCache) touch(ele *list.Element) {
+	kv := ele.Value.(*lfuEntry)
+	cur := kv.bucket
+	b := cur.Value.(*lfuBucket)
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != b.freq+1 {
+		next = c.buckets.InsertAfter(&lfuBucket{freq: b.freq + 1, entries: list.New()}, cur)
 	}
-	c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	b.entries.Remove(ele)
+	if b.entries.Len() == 0 {
+		c.buckets.Remove(cur)
+	}
+	kv.bucket = next
+	c.cache[kv.key] = next.Value.(*lfuBucket).entries.PushFront(kv)
 }
 
-func (c *LFUCache) Del(key string) {
-	if ele, ok := c.cache[key]; ok {
-		c.ll.Remove(ele)
-		kv := ele.Value.(*lfuEntry)
-		delete(c.cache, kv.key)
-		c.computeBytes(false, kv)
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
+// age halves every frequency once AgeEvery accesses have passed.
+// Buckets that end up with the same frequency are merged, the entries that
+// were more frequent staying in front.
+func (c *LFUCache) age() {
+	if c.AgeEvery == 0 {
+		return
+	}
+	if c.ops++; c.ops < c.AgeEvery {
+		return
+	}
+	c.ops = 0
+	var prev *list.Element
+	for cur := c.buckets.Front(); cur != nil; {
+		next := cur.Next()
+		b := cur.Value.(*lfuBucket)
+		if b.freq /= 2; b.freq < 1 {
+			b.freq = 1
 		}
+		if prev != nil && prev.Value.(*lfuBucket).freq == b.freq {
+			into := prev.Value.(*lfuBucket).entries
+			for ele := b.entries.Back(); ele != nil; ele = ele.Prev() {
+				kv := ele.Value.(*lfuEntry)
+				kv.bucket = prev
+				c.cache[kv.key] = into.PushFront(kv)
+			}
+			c.buckets.Remove(cur)
+		} else {
+			prev = cur
+		}
+		cur = next
 	}
 }
 
+// RemoveOldest removes the least frequently used item
 func (c *LFUCache) RemoveOldest() {
-	c.Del(c.ll.Back().Value.(*lfuEntry).key)
+	front := c.buckets.Front()
+	if front == nil {
+		return
+	}
+	c.remove(front.Value.(*lfuBucket).entries.Back())
 }
 
+// Del removes key from the cache
+func (c *LFUCache) Del(key string) {
+	if ele, ok := c.cache[key]; ok {
+		c.remove(ele)
+	}
+}
+
+func (c *LFUCache) remove(ele *list.Element) {
+	kv := ele.Value.(*lfuEntry)
+	b := kv.bucket.Value.(*lfuBucket)
+	b.entries.Remove(ele)
+	if b.entries.Len() == 0 {
+		c.buckets.Remove(kv.bucket)
+	}
+	delete(c.cache, kv.key)
+	c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
+	}
+}
+
+// Bytes returns the memory taken by keys and values in the cache
+func (c *LFUCache) Bytes() int64 {
+	return c.nBytes
+}
+
+// Len the number of cache entries
 func (c *LFUCache) Len() int {
-	return c.ll.Len()
+	return len(c.cache)
+}
 
+// Walk calls fn for every entry, least frequently used first
+func (c *LFUCache) Walk(fn func(key string, value Value)) {
+	for b := c.buckets.Front(); b != nil; b = b.Next() {
+		for ele := b.Value.(*lfuBucket).entries.Back(); ele != nil; ele = ele.Prev() {
+			kv := ele.Value.(*lfuEntry)
+			fn(kv.key, kv.value)
+		}
+	}
 }
@@ -65,7 +65,7 @@ func (c *LRUCache) Add(key string, value Value) {
 	if ele, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*lruEntry)
-		c.computeBytes(true, kv)
+		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
 	} else {
 		ele := c.ll.PushFront(&lruEntry{key, value})
@@ -96,7 +96,20 @@ func (c *LRUCache) Del(key string) {
 	}
 }
 
+// Bytes returns the memory taken by keys and values in the cache
+func (c *LRUCache) Bytes() int64 {
+	return c.nBytes
+}
+
 // Len the number of cache entries
 func (c *LRUCache) Len() int {
 	return c.ll.Len()
 }
+
+// Walk calls fn for every entry, least recently used first
+func (c *LRUCache) Walk(fn func(key string, value Value)) {
+	for ele := c.ll.Back(); ele != nil; ele = ele.Prev() {
+		kv := ele.Value.(*lruEntry)
+		fn(kv.key, kv.value)
+	}
+}
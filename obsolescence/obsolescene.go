@@ -5,5 +5,48 @@ type Cache interface {
 	Get(key string) (value Value, ok bool)
 	Del(key string)
 	Len() int
+	Bytes() int64
 	RemoveOldest()
+	// Walk calls fn for every entry, starting with the one that would be
+	// evicted first. fn must not modify the cache.
+	Walk(fn func(key string, value Value))
+}
+
+// A Policy creates an empty Cache that holds at most maxBytes and calls
+// onEvicted, which may be nil, for every entry it drops.
+type Policy func(maxBytes int64, onEvicted func(key string, value Value)) Cache
+
+// LRU is the Policy of LRUCache.
+func LRU(maxBytes int64, onEvicted func(string, Value)) Cache {
+	return NewLRUCache(maxBytes, onEvicted)
+}
+
+// LFU is the Policy of LFUCache.
+func LFU(maxBytes int64, onEvicted func(string, Value)) Cache {
+	return NewLFUCache(maxBytes, onEvicted)
+}
+
+// LFUWithAging returns the Policy of an LFUCache that halves every
+// frequency after every ageEvery accesses.
+func LFUWithAging(ageEvery int) Policy {
+	return func(maxBytes int64, onEvicted func(string, Value)) Cache {
+		c := NewLFUCache(maxBytes, onEvicted)
+		c.AgeEvery = ageEvery
+		return c
+	}
+}
+
+// FIFO is the Policy of FIFOCache.
+func FIFO(maxBytes int64, onEvicted func(string, Value)) Cache {
+	return NewFIFOCache(maxBytes, onEvicted)
+}
+
+// TinyLFU is the Policy of TinyLFUCache.
+func TinyLFU(maxBytes int64, onEvicted func(string, Value)) Cache {
+	return NewTinyLFUCache(maxBytes, onEvicted)
+}
+
+// ARC is the Policy of ARCCache.
+func ARC(maxBytes int64, onEvicted func(string, Value)) Cache {
+	return NewARCCache(maxBytes, onEvicted)
 }
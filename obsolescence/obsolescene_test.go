@@ -1,6 +1,7 @@
 package obsolescence
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -22,11 +23,11 @@ func testCacheGet(t *testing.T, cache Cache) {
 }
 
 // Helper function to test removeOldest functionality
-func testCacheRemoveOldest(t *testing.T, cache Cache) {
+func testCacheRemoveOldest(t *testing.T, policy Policy) {
 	k1, k2, k3 := "key1", "key2", "key3"
 	v1, v2, v3 := "value1", "value2", "value3"
 	cap := len(k1 + k2 + v1 + v2)
-	cache = NewLRUCache(int64(cap), nil)
+	cache := policy(int64(cap), nil)
 	cache.Add(k1, String(v1))
 	cache.Add(k2, String(v2))
 	cache.Add(k3, String(v3))
@@ -49,7 +50,7 @@ func TestLRUCache(t *testing.T) {
 
 	// Test removeOldest
 	t.Run("LRURemoveOldest", func(t *testing.T) {
-		testCacheRemoveOldest(t, lru)
+		testCacheRemoveOldest(t, LRU)
 	})
 }
 
@@ -65,7 +66,7 @@ func TestLFUCache(t *testing.T) {
 
 	// Test removeOldest
 	t.Run("LFURemoveOldest", func(t *testing.T) {
-		testCacheRemoveOldest(t, lfu)
+		testCacheRemoveOldest(t, LFU)
 	})
 
 }
@@ -82,6 +83,296 @@ func TestFIFOCache(t *testing.T) {
 
 	// Test removeOldest
 	t.Run("FIFORemoveOldest", func(t *testing.T) {
-		testCacheRemoveOldest(t, fifo)
+		testCacheRemoveOldest(t, FIFO)
 	})
 }
+
+func TestLFUEvictsLeastFrequent(t *testing.T) {
+	var evicted []string
+	lfu := NewLFUCache(int64(len("k1v1k2v2")), func(key string, value Value) {
+		evicted = append(evicted, key)
+	})
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	lfu.Get("k1")
+	lfu.Add("k3", String("v3")) // k2 is the least frequently used
+	if _, ok := lfu.Get("k2"); ok || lfu.Len() != 2 {
+		t.Fatalf("LFU kept k2, the least frequently used key")
+	}
+	if _, ok := lfu.Get("k1"); !ok {
+		t.Fatalf("LFU evicted k1, the most frequently used key")
+	}
+	if len(evicted) != 1 || evicted[0] != "k2" {
+		t.Fatalf("OnEvicted got %v, want [k2]", evicted)
+	}
+	if lfu.Bytes() != int64(len("k1v1k3v3")) {
+		t.Fatalf("Bytes() = %d, want %d", lfu.Bytes(), len("k1v1k3v3"))
+	}
+}
+
+func TestLFUTiesByRecency(t *testing.T) {
+	lfu := NewLFUCache(int64(len("k1v1k2v2k3v3")), nil)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	lfu.Add("k3", String("v3"))
+	lfu.Get("k2")
+	lfu.Get("k1")
+	lfu.Get("k3")
+	lfu.RemoveOldest() // all have freq 2, k2 was used the longest ago
+	if _, ok := lfu.Get("k2"); ok {
+		t.Fatalf("RemoveOldest kept k2, the least recently used of equal frequency")
+	}
+}
+
+func TestLFUBytesOnUpdate(t *testing.T) {
+	lfu := NewLFUCache(0, nil)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k1", String("value1"))
+	if want := int64(len("k1value1")); lfu.Bytes() != want {
+		t.Fatalf("Bytes() = %d after update, want %d", lfu.Bytes(), want)
+	}
+	lfu.Del("k1")
+	if lfu.Bytes() != 0 || lfu.Len() != 0 {
+		t.Fatalf("Bytes() = %d, Len() = %d after Del, want 0", lfu.Bytes(), lfu.Len())
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	lfu := NewLFUCache(0, nil)
+	lfu.Add("old", String("v"))
+	for i := 0; i < 8; i++ {
+		lfu.Get("old")
+	}
+	lfu.Add("new", String("v"))
+	lfu.Get("new")
+	lfu.Get("new")
+	lfu.RemoveOldest()
+	if _, ok := lfu.cache["new"]; ok {
+		t.Fatalf("without aging the new key should be evicted first")
+	}
+
+	lfu = NewLFUCache(0, nil)
+	lfu.AgeEvery = 4
+	lfu.Add("old", String("v"))
+	for i := 0; i < 8; i++ {
+		lfu.Get("old") // frequency is halved twice along the way
+	}
+	lfu.Add("new", String("v"))
+	lfu.Get("new")
+	lfu.Get("new")
+	lfu.Get("new")
+	lfu.RemoveOldest()
+	if _, ok := lfu.cache["old"]; ok {
+		t.Fatalf("aging did not let the old hot key age out")
+	}
+	if lfu.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", lfu.Len())
+	}
+}
+
+// -------------------- W-TinyLFU 测试 --------------------
+
+func TestTinyLFUCache(t *testing.T) {
+	tinyLFU := NewTinyLFUCache(int64(0), nil)
+
+	// Test Get
+	t.Run("TinyLFUGet", func(t *testing.T) {
+		testCacheGet(t, tinyLFU)
+	})
+}
+
+func TestTinyLFUScanResistance(t *testing.T) {
+	hot := []string{"hot0", "hot1", "hot2", "hot3", "hot4"}
+	// room for about 10 entries of 10 bytes each
+	for _, tt := range []struct {
+		policy  Policy
+		wantHot bool
+	}{
+		{LRU, false},
+		{TinyLFU, true},
+	} {
+		cache := tt.policy(100, nil)
+		for round := 0; round < 5; round++ {
+			for _, k := range hot {
+				if _, ok := cache.Get(k); !ok {
+					cache.Add(k, String("value1"))
+				}
+			}
+		}
+		// a scan of one-off keys, twice the size of the cache
+		for i := 0; i < 20; i++ {
+			cache.Add(fmt.Sprintf("sc%02d", i), String("value1"))
+		}
+		kept := 0
+		for _, k := range hot {
+			if _, ok := cache.Get(k); ok {
+				kept++
+			}
+		}
+		if tt.wantHot && kept != len(hot) {
+			t.Fatalf("TinyLFU kept %d of %d hot keys after a scan", kept, len(hot))
+		}
+		if !tt.wantHot && kept != 0 {
+			t.Fatalf("LRU kept %d hot keys, the scan should have flushed them", kept)
+		}
+		if cache.Bytes() > 100 {
+			t.Fatalf("Bytes() = %d, over the 100 byte budget", cache.Bytes())
+		}
+	}
+}
+
+func TestTinyLFUOnEvicted(t *testing.T) {
+	evicted := 0
+	cache := NewTinyLFUCache(100, func(key string, value Value) {
+		evicted++
+	})
+	for i := 0; i < 30; i++ {
+		cache.Add(fmt.Sprintf("key%02d", i), String("value"))
+	}
+	if cache.Len()+evicted != 30 {
+		t.Fatalf("Len() = %d, evicted %d, want them to add up to 30", cache.Len(), evicted)
+	}
+	if cache.Bytes() > 100 {
+		t.Fatalf("Bytes() = %d, over the 100 byte budget", cache.Bytes())
+	}
+	cache.Del("key29")
+	for cache.Len() > 0 {
+		cache.RemoveOldest()
+	}
+	if cache.Bytes() != 0 {
+		t.Fatalf("Bytes() = %d after emptying the cache, want 0", cache.Bytes())
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(64)
+	for i := 0; i < 10; i++ {
+		s.Increment("hot")
+	}
+	s.Increment("cold")
+	if got := s.Estimate("hot"); got != 10 {
+		t.Fatalf("Estimate(hot) = %d, want 10", got)
+	}
+	if got := s.Estimate("missing"); got > 1 {
+		t.Fatalf("Estimate(missing) = %d, want at most 1", got)
+	}
+	s.Reset()
+	if got := s.Estimate("hot"); got != 5 {
+		t.Fatalf("Estimate(hot) = %d after Reset, want 5", got)
+	}
+}
+
+// -------------------- ARC 测试 --------------------
+
+func TestARCCache(t *testing.T) {
+	arc := NewARCCache(int64(0), nil)
+
+	// Test Get
+	t.Run("ARCGet", func(t *testing.T) {
+		testCacheGet(t, arc)
+	})
+
+	// Test removeOldest
+	t.Run("ARCRemoveOldest", func(t *testing.T) {
+		testCacheRemoveOldest(t, ARC)
+	})
+}
+
+func TestARCAdaptation(t *testing.T) {
+	var evicted []string
+	// room for four entries of 10 bytes
+	arc := NewARCCache(40, func(key string, value Value) {
+		evicted = append(evicted, key)
+	})
+	add := func(keys ...string) {
+		for _, k := range keys {
+			arc.Add(k, String("value123"))
+		}
+	}
+
+	add("k0", "k1")
+	arc.Get("k0")
+	arc.Get("k1")
+	add("k2", "k3")
+
+	// recency phase: a key evicted from T1 comes back, T1 should have been bigger
+	add("k4")
+	if len(evicted) != 1 || evicted[0] != "k2" || arc.p != 0 {
+		t.Fatalf("evicted %v with p = %d, want [k2] with p = 0", evicted, arc.p)
+	}
+	add("k2")
+	if arc.p != 10 {
+		t.Fatalf("p = %d after a B1 ghost hit, want 10", arc.p)
+	}
+	if ele := arc.cache["k2"]; ele.Value.(*arcEntry).list != arcT2 {
+		t.Fatalf("a B1 ghost hit should come back into T2")
+	}
+
+	// frequency phase: a key evicted from T2 comes back, T2 should have been bigger
+	arc.Get("k4")
+	add("k5")
+	if last := evicted[len(evicted)-1]; last != "k0" {
+		t.Fatalf("evicted %s, want k0, the least recently used key of T2", last)
+	}
+	add("k0")
+	if arc.p != 0 {
+		t.Fatalf("p = %d after a B2 ghost hit, want 0", arc.p)
+	}
+
+	if arc.Bytes() > 40 || arc.Len() != 4 {
+		t.Fatalf("Bytes() = %d, Len() = %d, want at most 40 bytes in 4 entries", arc.Bytes(), arc.Len())
+	}
+	if ghosts := arc.bytes[arcT1] + arc.bytes[arcB1]; ghosts > 40 {
+		t.Fatalf("T1+B1 = %d bytes, over the 40 byte budget", ghosts)
+	}
+	if total := arc.Bytes() + arc.bytes[arcB1] + arc.bytes[arcB2]; total > 80 {
+		t.Fatalf("T1+T2+B1+B2 = %d bytes, over twice the budget", total)
+	}
+}
+
+func TestARCScanKeepsFrequent(t *testing.T) {
+	arc := NewARCCache(40, nil)
+	for _, k := range []string{"h0", "h1"} {
+		arc.Add(k, String("value123"))
+		arc.Get(k)
+	}
+	for i := 0; i < 20; i++ {
+		arc.Add(fmt.Sprintf("s%d", i%10), String("value123"))
+	}
+	for _, k := range []string{"h0", "h1"} {
+		if _, ok := arc.Get(k); !ok {
+			t.Fatalf("a scan of one-off keys flushed frequent key %s out of T2", k)
+		}
+	}
+}
+
+// -------------------- Walk 测试 --------------------
+
+func TestWalkStartsWithVictim(t *testing.T) {
+	policies := map[string]Policy{"lru": LRU, "lfu": LFU, "fifo": FIFO, "tinylfu": TinyLFU, "arc": ARC}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			cache := policy(0, nil)
+			for _, k := range []string{"key1", "key2", "key3"} {
+				cache.Add(k, String("v"+k))
+			}
+			cache.Get("key1")
+			cache.Get("key1")
+
+			var keys []string
+			cache.Walk(func(key string, value Value) {
+				if string(value.(String)) != "v"+key {
+					t.Fatalf("Walk gave %s=%s", key, value)
+				}
+				keys = append(keys, key)
+			})
+			if len(keys) != 3 {
+				t.Fatalf("Walk visited %v, want 3 keys", keys)
+			}
+			cache.RemoveOldest()
+			if _, ok := cache.Get(keys[0]); ok || cache.Len() != 2 {
+				t.Fatalf("Walk started with %s, but RemoveOldest kept it", keys[0])
+			}
+		})
+	}
+}
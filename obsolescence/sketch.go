@@ -0,0 +1,79 @@
+package obsolescence
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+const (
+	cmDepth      = 4
+	cmMaxCounter = 15
+)
+
+// MaxEstimate is the largest count a CountMinSketch estimates, every key
+// seen more often than that is estimated at MaxEstimate.
+const MaxEstimate = cmMaxCounter
+
+// CountMinSketch estimates how often keys were seen in constant memory.
+// Estimates never undercount, and saturate at 15, which is all an admission
+// or promotion policy needs to tell hot keys from cold ones.
+// It is not safe for concurrent access.
+type CountMinSketch struct {
+	rows [cmDepth][]uint8
+	mask uint64
+	seed maphash.Seed
+}
+
+// NewCountMinSketch creates a sketch with width counters per row, rounded
+// up to a power of two. Width should be in the order of the number of
+// distinct keys expected between two Resets.
+func NewCountMinSketch(width int) *CountMinSketch {
+	if width < 16 {
+		width = 16
+	}
+	width = 1 << bits.Len(uint(width-1))
+	s := &CountMinSketch{mask: uint64(width - 1), seed: maphash.MakeSeed()}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index returns the counter of key in row i, derived from a single hash by
+// double hashing.
+func (s *CountMinSketch) index(h uint64, i int) uint64 {
+	h1, h2 := h&0xffffffff, h>>32|1
+	return (h1 + uint64(i)*h2) & s.mask
+}
+
+// Increment counts one more occurrence of key.
+func (s *CountMinSketch) Increment(key string) {
+	h := maphash.String(s.seed, key)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < cmMaxCounter {
+			*c++
+		}
+	}
+}
+
+// Estimate returns how often key was seen, at most 15.
+func (s *CountMinSketch) Estimate(key string) int {
+	h := maphash.String(s.seed, key)
+	est := uint8(cmMaxCounter)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < est {
+			est = c
+		}
+	}
+	return int(est)
+}
+
+// Reset halves every counter, so that old occurrences weigh less than
+// recent ones.
+func (s *CountMinSketch) Reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package obsolescence
+
+import (
+	"container/list"
+	"hash/maphash"
+	"math/bits"
+)
+
+const (
+	// tinyLFUAvgEntryBytes sizes the frequency sketch from the byte budget.
+	tinyLFUAvgEntryBytes = 64
+	tinyLFUMinWidth      = 1 << 10
+	tinyLFUMaxWidth      = 1 << 20
+)
+
+// segments of a TinyLFUCache
+const (
+	windowSeg = iota
+	probationSeg
+	protectedSeg
+)
+
+// TinyLFUCache is a Window-TinyLFU cache. New entries land in a small LRU
+// window (1% of maxBytes); entries leaving the window only make it into the
+// segmented LRU main region (probation + protected) if the frequency sketch
+// says they are used more often than the entry they would push out, so a
+// scan of one-off keys cannot flush the hot ones.
+// It is not safe for concurrent access.
+type TinyLFUCache struct {
+	maxBytes     int64
+	windowMax    int64
+	mainMax      int64
+	protectedMax int64
+
+	lists [3]*list.List // per segment, most recently used at the front
+	bytes [3]int64      // per segment
+	cache map[string]*list.Element
+
+	sketch     *CountMinSketch
+	doorkeeper *doorkeeper
+	samples    int // accesses counted since the last sketch reset
+	sampleSize int
+
+	OnEvicted func(key string, value Value) // optional and executed when an entry is purged.
+}
+
+type tinyLFUEntry struct {
+	key   string
+	value Value
+	seg   int
+}
+
+func (e *tinyLFUEntry) size() int64 {
+	return int64(len(e.key)) + int64(e.value.Len())
+}
+
+// NewTinyLFUCache is the Constructor of TinyLFUCache
+func NewTinyLFUCache(maxBytes int64, onEvicted func(string, Value)) *TinyLFUCache {
+	width := int(maxBytes / tinyLFUAvgEntryBytes)
+	if width < tinyLFUMinWidth {
+		width = tinyLFUMinWidth
+	} else if width > tinyLFUMaxWidth {
+		width = tinyLFUMaxWidth
+	}
+	c := &TinyLFUCache{
+		maxBytes:   maxBytes,
+		windowMax:  maxBytes / 100,
+		cache:      make(map[string]*list.Element),
+		sketch:     NewCountMinSketch(width),
+		doorkeeper: newDoorkeeper(width * 8),
+		sampleSize: width * 10,
+		OnEvicted:  onEvicted,
+	}
+	c.mainMax = maxBytes - c.windowMax
+	c.protectedMax = c.mainMax * 80 / 100
+	for i := range c.lists {
+		c.lists[i] = list.New()
+	}
+	return c
+}
+
+// record counts an access to key. The first access only goes into the
+// doorkeeper, so keys seen once never take room in the sketch.
+func (c *TinyLFUCache) record(key string) {
+	if !c.doorkeeper.add(key) {
+		c.sketch.Increment(key)
+	}
+	if c.samples++; c.samples >= c.sampleSize {
+		c.samples = 0
+		c.sketch.Reset()
+		c.doorkeeper.reset()
+	}
+}
+
+func (c *TinyLFUCache) frequency(key string) int {
+	f := c.sketch.Estimate(key)
+	if c.doorkeeper.contains(key) {
+		f++
+	}
+	return f
+}
+
+// Get look ups a key's value
+func (c *TinyLFUCache) Get(key string) (value Value, ok bool) {
+	c.record(key)
+	if ele, ok := c.cache[key]; ok {
+		c.touch(ele)
+		return ele.Value.(*tinyLFUEntry).value, true
+	}
+	return
+}
+
+// Add adds a value to the window, or updates it where it is.
+func (c *TinyLFUCache) Add(key string, value Value) {
+	c.record(key)
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*tinyLFUEntry)
+		c.bytes[kv.seg] += int64(value.Len()) - int64(kv.value.Len())
+		kv.value = value
+		c.touch(ele)
+	} else {
+		kv := &tinyLFUEntry{key: key, value: value, seg: windowSeg}
+		c.cache[key] = c.lists[windowSeg].PushFront(kv)
+		c.bytes[windowSeg] += kv.size()
+	}
+	c.maintain()
+}
+
+// touch moves ele to the front of its segment, promoting it from probation
+// to protected.
+func (c *TinyLFUCache) touch(ele *list.Element) {
+	kv := ele.Value.(*tinyLFUEntry)
+	if kv.seg == probationSeg {
+		c.move(ele, protectedSeg)
+		c.maintain()
+		return
+	}
+	c.lists[kv.seg].MoveToFront(ele)
+}
+
+// move moves ele to the front of segment seg.
+func (c *TinyLFUCache) move(ele *list.Element, seg int) {
+	kv := ele.Value.(*tinyLFUEntry)
+	c.lists[kv.seg].Remove(ele)
+	c.bytes[kv.seg] -= kv.size()
+	kv.seg = seg
+	c.cache[kv.key] = c.lists[seg].PushFront(kv)
+	c.bytes[seg] += kv.size()
+}
+
+// maintain brings every segment back within its share of maxBytes.
+func (c *TinyLFUCache) maintain() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.bytes[protectedSeg] > c.protectedMax {
+		c.move(c.lists[protectedSeg].Back(), probationSeg)
+	}
+	for c.bytes[windowSeg] > c.windowMax {
+		c.admit(c.lists[windowSeg].Back())
+	}
+	for c.bytes[probationSeg]+c.bytes[protectedSeg] > c.mainMax {
+		c.remove(c.mainVictim())
+	}
+}
+
+// admit moves the candidate leaving the window into probation if it is
+// used more often than every main entry it needs to push out, and evicts
+// it otherwise.
+func (c *TinyLFUCache) admit(candidate *list.Element) {
+	kv := candidate.Value.(*tinyLFUEntry)
+	freq := c.frequency(kv.key)
+	for c.bytes[probationSeg]+c.bytes[protectedSeg]+kv.size() > c.mainMax {
+		victim := c.mainVictim()
+		if victim == nil || freq <= c.frequency(victim.Value.(*tinyLFUEntry).key) {
+			c.remove(candidate)
+			return
+		}
+		c.remove(victim)
+	}
+	c.move(candidate, probationSeg)
+}
+
+// mainVictim returns the main region entry to evict next.
+func (c *TinyLFUCache) mainVictim() *list.Element {
+	if ele := c.lists[probationSeg].Back(); ele != nil {
+		return ele
+	}
+	return c.lists[protectedSeg].Back()
+}
+
+// RemoveOldest removes the entry the cache would evict next
+func (c *TinyLFUCache) RemoveOldest() {
+	if ele := c.mainVictim(); ele != nil {
+		c.remove(ele)
+	} else if ele := c.lists[windowSeg].Back(); ele != nil {
+		c.remove(ele)
+	}
+}
+
+// Del removes key from the cache
+func (c *TinyLFUCache) Del(key string) {
+	if ele, ok := c.cache[key]; ok {
+		c.remove(ele)
+	}
+}
+
+func (c *TinyLFUCache) remove(ele *list.Element) {
+	kv := ele.Value.(*tinyLFUEntry)
+	c.lists[kv.seg].Remove(ele)
+	c.bytes[kv.seg] -= kv.size()
+	delete(c.cache, kv.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
+	}
+}
+
+// Bytes returns the memory taken by keys and values in the cache
+func (c *TinyLFUCache) Bytes() int64 {
+	return c.bytes[windowSeg] + c.bytes[probationSeg] + c.bytes[protectedSeg]
+}
+
+// Len the number of cache entries
+func (c *TinyLFUCache) Len() int {
+	return len(c.cache)
+}
+
+// Walk calls fn for every entry: probation, then protected, then the
+// window, each least recently used first
+func (c *TinyLFUCache) Walk(fn func(key string, value Value)) {
+	for _, seg := range []int{probationSeg, protectedSeg, windowSeg} {
+		for ele := c.lists[seg].Back(); ele != nil; ele = ele.Prev() {
+			kv := ele.Value.(*tinyLFUEntry)
+			fn(kv.key, kv.value)
+		}
+	}
+}
+
+// doorkeeper is a bloom filter remembering which keys were seen at least
+// once since the last reset.
+type doorkeeper struct {
+	bits []uint64
+	mask uint64
+	seed maphash.Seed
+}
+
+// newDoorkeeper creates a doorkeeper of nbits bits, rounded up to a power
+// of two no smaller than 64.
+func newDoorkeeper(nbits int) *doorkeeper {
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbits = 1 << bits.Len(uint(nbits-1))
+	return &doorkeeper{bits: make([]uint64, nbits/64), mask: uint64(nbits - 1), seed: maphash.MakeSeed()}
+}
+
+func (d *doorkeeper) positions(key string) (uint64, uint64) {
+	h := maphash.String(d.seed, key)
+	return h & d.mask, (h >> 32) & d.mask
+}
+
+// add adds key and reports whether it was already present.
+func (d *doorkeeper) add(key string) bool {
+	present := true
+	p1, p2 := d.positions(key)
+	for _, p := range []uint64{p1, p2} {
+		if d.bits[p/64]&(1<<(p%64)) == 0 {
+			present = false
+			d.bits[p/64] |= 1 << (p % 64)
+		}
+	}
+	return present
+}
+
+func (d *doorkeeper) contains(key string) bool {
+	p1, p2 := d.positions(key)
+	return d.bits[p1/64]&(1<<(p1%64)) != 0 && d.bits[p2/64]&(1<<(p2%64)) != 0
+}
+
+func (d *doorkeeper) reset() {
+	for i := range d.bits {
+		d.bits[i] = 0
+	}
+}
@@ -0,0 +1,155 @@
+package GoDistributedCache
+
+import (
+	"GoDistributedCache/diskcache"
+	"GoDistributedCache/obsolescence"
+	"time"
+)
+
+// A GroupOption configures optional behaviour of a Group in NewGroup.
+type GroupOption func(*Group)
+
+// WithTTL makes every value loaded by the Group's Getter expire ttl after it
+// was loaded. A TTLGetter can still choose a different ttl per key.
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.ttl = ttl
+	}
+}
+
+// WithSweepInterval sets how often expired entries are swept from the cache.
+// Expired entries are always dropped when read, the sweeper only reclaims
+// the space of those nobody reads again. Defaults to one minute.
+func WithSweepInterval(d time.Duration) GroupOption {
+	return func(g *Group) {
+		g.mainCache.sweepInterval = d
+		g.hotCache.sweepInterval = d
+		g.negCache.sweepInterval = d
+	}
+}
+
+// WithEvictionPolicy picks the policy deciding which entries leave the cache
+// when it is full, e.g. obsolescence.LFU. Defaults to obsolescence.LRU.
+func WithEvictionPolicy(policy obsolescence.Policy) GroupOption {
+	return func(g *Group) {
+		g.mainCache.policy = policy
+	}
+}
+
+// WithHotCacheBytes sets the byte budget of the hot cache, which holds
+// copies of other peers' keys that are requested often on this node.
+// Defaults to an eighth of the Group's cacheBytes, 0 means unlimited.
+func WithHotCacheBytes(n int64) GroupOption {
+	return func(g *Group) {
+		g.hotCache.cacheBytes = n
+	}
+}
+
+// WithHotKeyThreshold sets how many recent requests a key owned by another
+// peer needs before its value is kept in the hot cache. Defaults to 4,
+// 1 keeps every value fetched from a peer. Requests are counted up to 15,
+// so n is clamped to 1..15.
+func WithHotKeyThreshold(n int) GroupOption {
+	return func(g *Group) {
+		g.promoter = newPromoter(n)
+	}
+}
+
+// WithHotKeyReplication makes the Group find, among the keys it owns, the
+// topK that peers requested at least minCount times over the last window,
+// and push them into every peer's hot cache. Peers then serve them without
+// asking the owner, until it retracts them once they cool down or their
+// lease of one window runs out. A window too short to be divided into
+// slots falls back to one minute and a topK below 1 to 10, minCount is at
+// least 1.
+func WithHotKeyReplication(window time.Duration, topK int, minCount int64) GroupOption {
+	return func(g *Group) {
+		g.hotKeys = newHotKeyReplicator(g, window, topK, minCount)
+	}
+}
+
+// WithShards splits the Group's caches into n shards, each with its
+// own lock and an equal part of the byte budget, so parallel Gets of
+// different keys do not contend on a single mutex. Eviction then picks its
+// victim within a shard rather than across the whole cache. Defaults to 1.
+func WithShards(n int) GroupOption {
+	return func(g *Group) {
+		g.mainCache.nshards = n
+		g.hotCache.nshards = n
+		g.negCache.nshards = n
+	}
+}
+
+// WithRingStorage stores the main cache's entries in one preallocated ring
+// of bytes per shard instead of a heap object per entry, which keeps GC
+// pauses short for caches of millions of small values. The ring is sized
+// from cacheBytes, 64MiB if unlimited, and also holds a 24 byte header per
+// entry. It evicts in insertion order, replacing WithEvictionPolicy.
+func WithRingStorage() GroupOption {
+	return func(g *Group) {
+		g.mainCache.policy = newRingStorage
+	}
+}
+
+// WithDiskCache adds store as a second tier beneath the main cache: entries
+// evicted from memory are written to it, and keys given a new value are
+// deleted from it, in the background, and a Get that misses the cache
+// looks there before asking the owning peer or the Getter.
+func WithDiskCache(store *diskcache.Store) GroupOption {
+	return func(g *Group) {
+		g.disk = newDiskTier(store)
+		g.mainCache.evicted = g.spillToDisk
+	}
+}
+
+// WithNegativeCache sets how long keys the Getter reported as ErrNotFound
+// are remembered as missing, and the byte budget for remembering them.
+// Defaults to 10 seconds and a sixteenth of the Group's cacheBytes, a ttl
+// of 0 turns negative caching off.
+func WithNegativeCache(ttl time.Duration, maxBytes int64) GroupOption {
+	return func(g *Group) {
+		g.negTTL = ttl
+		g.negCache.cacheBytes = maxBytes
+	}
+}
+
+// WithHedging makes a Get whose owner has not answered within delay also
+// load the key with the local Getter, and take whichever answers first.
+// It trades extra Getter load for a shorter tail when one peer is slow.
+// Off by default.
+func WithHedging(delay time.Duration) GroupOption {
+	return func(g *Group) {
+		g.hedgeDelay = delay
+	}
+}
+
+// WithPeerRetries makes a Get ask the owner again, up to n times, when the
+// request failed in transport, e.g. on a reset connection. Each retry
+// waits a random time of up to backoff, doubled on every retry. Errors the
+// peer answered with are never retried. Off by default.
+func WithPeerRetries(n int, backoff time.Duration) GroupOption {
+	return func(g *Group) {
+		g.peerRetries = n
+		g.retryBackoff = backoff
+	}
+}
+
+// WithReplication makes the owner of a key push every value it loads or is
+// Set to the n-1 peers after it on the ring, and drop it there on Remove.
+// Those are the peers its keys move to when it leaves the ring, so they
+// can answer from their cache instead of all reloading at once. Needs a
+// PeerPicker that implements ReplicaPicker. Defaults to 1, no replicas.
+func WithReplication(n int) GroupOption {
+	return func(g *Group) {
+		g.replicas = n
+	}
+}
+
+// WithSnapshotMaxAge makes Restore refuse, with ErrStaleSnapshot, snapshots
+// taken more than d ago, so a node does not serve the values of one left
+// behind by an earlier rollout. Defaults to 0, any age.
+func WithSnapshotMaxAge(d time.Duration) GroupOption {
+	return func(g *Group) {
+		g.snapshotMaxAge = d
+	}
+}
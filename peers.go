@@ -1,16 +1,39 @@
 package GoDistributedCache
 
-import pb "GoDistributedCache/cachepb"
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+)
 
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
 type PeerPicker interface {
 	PickPeer(key string) (peer PeerGetter, ok bool)
 	GetPeers() string
+	// AllPeers returns a getter for every remote peer, used to broadcast
+	// invalidations.
+	AllPeers() []PeerGetter
+}
+
+// A ReplicaPicker is a PeerPicker that can also name the peers following
+// the owner of a key on the ring, which keep replicas of it with
+// WithReplication.
+type ReplicaPicker interface {
+	PeerPicker
+	// PickReplicas returns the peers among the first n nodes for key,
+	// the owner first, leaving this node out.
+	PickReplicas(key string, n int) []PeerGetter
 }
 
 // PeerGetter is the interface that must be implemented to get the value
 // 用来从对应 group 查找缓存值
 type PeerGetter interface {
-	Get(in *pb.Request, out *pb.Response) error
+	Get(ctx context.Context, in *pb.Request, out *pb.Response) error
+	// Set stores in.Value under in.Key in the peer's own cache
+	Set(ctx context.Context, in *pb.Request) error
+	// Remove drops in.Key from the peer's own cache
+	Remove(ctx context.Context, in *pb.Request) error
+	// GetMulti gets many keys in one request. Keys the peer could not load
+	// are in out.Values too, with the Status of their error
+	GetMulti(ctx context.Context, in *pb.BatchRequest, out *pb.BatchResponse) error
 }
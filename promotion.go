@@ -0,0 +1,52 @@
+package GoDistributedCache
+
+import (
+	"GoDistributedCache/obsolescence"
+	"sync"
+)
+
+const (
+	defaultHotKeyThreshold = 4
+	promoterSketchWidth    = 1 << 12
+)
+
+// promoter decides which values fetched from peers are worth a copy in the
+// hot cache. It counts the requests for each key in a CountMinSketch that is
+// halved every promoterSketchWidth*10 requests, so a key is promoted once it
+// has been asked for at least threshold times in the recent past.
+type promoter struct {
+	mu         sync.Mutex
+	sketch     *obsolescence.CountMinSketch
+	threshold  int
+	samples    int
+	sampleSize int
+}
+
+// newPromoter clamps threshold to 1..obsolescence.MaxEstimate, a higher
+// threshold would never be reached by the sketch's saturating counters.
+func newPromoter(threshold int) *promoter {
+	threshold = min(max(threshold, 1), obsolescence.MaxEstimate)
+	return &promoter{
+		sketch:     obsolescence.NewCountMinSketch(promoterSketchWidth),
+		threshold:  threshold,
+		sampleSize: promoterSketchWidth * 10,
+	}
+}
+
+// record counts a request for key.
+func (p *promoter) record(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sketch.Increment(key)
+	if p.samples++; p.samples >= p.sampleSize {
+		p.samples = 0
+		p.sketch.Reset()
+	}
+}
+
+// hot reports whether key has been requested often enough to be promoted.
+func (p *promoter) hot(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sketch.Estimate(key) >= p.threshold
+}
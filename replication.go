@@ -0,0 +1,97 @@
+package GoDistributedCache
+
+import (
+	pb "GoDistributedCache/cachepb"
+	"context"
+	"errors"
+	"log"
+)
+
+// replicaPeers returns the peers that keep replicas of key, if this node
+// replicates at all.
+func (g *Group) replicaPeers(key string) []PeerGetter {
+	if g.replicas <= 1 || g.peers == nil {
+		return nil
+	}
+	picker, ok := g.peers.(ReplicaPicker)
+	if !ok {
+		return nil
+	}
+	return picker.PickReplicas(key, g.replicas)
+}
+
+// replicate pushes value, which this node owns, to the peers after it on
+// the ring.
+func (g *Group) replicate(key string, value ByteView) {
+	for _, peer := range g.replicaPeers(key) {
+		err := peer.Set(context.Background(), &pb.Request{
+			Group:   g.name,
+			Key:     key,
+			Value:   value.ByteSlice(),
+			Expire:  expireToNano(value.Expire()),
+			Replica: true,
+		})
+		if err != nil {
+			log.Println("[GoDistributedCache] Failed to replicate", key, err)
+		}
+	}
+}
+
+// dropReplicas removes key from the peers that keep replicas of it.
+func (g *Group) dropReplicas(key string) {
+	for _, peer := range g.replicaPeers(key) {
+		err := peer.Remove(context.Background(), &pb.Request{Group: g.name, Key: key, Replica: true})
+		if err != nil {
+			log.Println("[GoDistributedCache] Failed to drop replica", key, err)
+		}
+	}
+}
+
+// askReplicas asks the peers keeping replicas of key, in ring order, for
+// the value while the circuit breaker of owner is open. ok is false if none
+// of them answered, or if this node keeps a replica itself, and the key is
+// then loaded locally.
+func (g *Group) askReplicas(ctx context.Context, owner PeerGetter, key string) (value ByteView, ok bool, err error) {
+	peers := g.replicaPeers(key)
+	// 本节点自己就是副本之一，说明 owner 下线后 key 会落到这里，直接本地加载
+	if len(peers) < g.replicas {
+		return ByteView{}, false, nil
+	}
+	for _, peer := range peers {
+		if peer == owner {
+			continue
+		}
+		value, err = g.askPeer(ctx, peer, key)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return value, true, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return ByteView{}, false, nil
+}
+
+// removeFromPeer drops a key a peer asked this node to remove. A hot
+// retraction only drops the copy in the hot cache. Otherwise, when this
+// node owns the key, it drops the key's replicas too; Invalidate sends the
+// same request to every peer, and only the owner should pass it on.
+func (g *Group) removeFromPeer(key string, in *pb.Request) {
+	if in.GetHot() {
+		g.hotCache.remove(key)
+		return
+	}
+	g.removeLocally(key)
+	if !in.GetReplica() && g.replicas > 1 && g.ownsKey(key) {
+		go g.dropReplicas(key)
+	}
+}
+
+// ownsKey reports whether the ring routes key to this node.
+func (g *Group) ownsKey(key string) bool {
+	if g.peers == nil {
+		return true
+	}
+	_, ok := g.peers.PickPeer(key)
+	return !ok
+}
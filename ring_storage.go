@@ -0,0 +1,63 @@
+package GoDistributedCache
+
+import (
+	"GoDistributedCache/obsolescence"
+	"GoDistributedCache/ringstore"
+)
+
+// defaultRingBytes is the ring allocated for a cache without a byte budget,
+// since a ring cannot grow.
+const defaultRingBytes = 64 << 20
+
+// ringStorage keeps a cache's ByteViews in a ringstore.Store, so that
+// millions of entries cost the garbage collector nothing to scan.
+type ringStorage struct {
+	s *ringstore.Store
+}
+
+func newRingStorage(maxBytes int64, onEvicted func(string, obsolescence.Value)) obsolescence.Cache {
+	if maxBytes == 0 {
+		maxBytes = defaultRingBytes
+	}
+	return &ringStorage{s: ringstore.New(maxBytes, func(key string, value []byte) {
+		if onEvicted != nil {
+			onEvicted(key, unmarshalWithExpiry(value))
+		}
+	})}
+}
+
+func (r *ringStorage) Add(key string, value obsolescence.Value) {
+	r.s.Add(key, value.(ByteView).marshalWithExpiry())
+}
+
+func (r *ringStorage) Get(key string) (obsolescence.Value, bool) {
+	b, ok := r.s.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return unmarshalWithExpiry(b), true
+}
+
+func (r *ringStorage) Del(key string) {
+	r.s.Del(key)
+}
+
+func (r *ringStorage) RemoveOldest() {
+	r.s.RemoveOldest()
+}
+
+// Bytes leaves out the expiries, like the other caches count only keys and
+// values.
+func (r *ringStorage) Bytes() int64 {
+	return r.s.Bytes() - 8*int64(r.s.Len())
+}
+
+func (r *ringStorage) Len() int {
+	return r.s.Len()
+}
+
+func (r *ringStorage) Walk(fn func(key string, value obsolescence.Value)) {
+	r.s.Walk(func(key string, value []byte) {
+		fn(key, unmarshalWithExpiry(value))
+	})
+}
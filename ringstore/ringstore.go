@@ -0,0 +1,236 @@
+package ringstore
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+)
+
+// headerSize is the size of the header written before every entry:
+// the key's hash, the key length and the value length.
+const headerSize = 8 + 4 + 4
+
+// MaxCapacity is the largest ring a Store can index with uint32 offsets.
+const MaxCapacity = math.MaxUint32
+
+// Store keeps entries back to back in one preallocated ring of bytes,
+// indexed by a map from the hash of the key to the entry's offset. Neither
+// holds a pointer, so the garbage collector has nothing to scan no matter
+// how many entries are stored.
+// New entries are written at the head, overwriting the oldest ones at the
+// tail when the ring is full, so eviction is in insertion order. Updated
+// and deleted entries leave garbage behind until the head wraps over them.
+// It is not safe for concurrent access.
+type Store struct {
+	buf   []byte
+	head  uint64 // logical offset of the next write, buf[head%len(buf)]
+	tail  uint64 // logical offset of the oldest entry
+	index map[uint64]uint32
+	seed  maphash.Seed
+	bytes int64 // keys and values of live entries
+
+	OnEvicted func(key string, value []byte) // optional and executed when a live entry is purged.
+}
+
+// New creates a Store with a ring of capacity bytes, at most MaxCapacity.
+func New(capacity int64, onEvicted func(string, []byte)) *Store {
+	if capacity > MaxCapacity {
+		capacity = MaxCapacity
+	}
+	return &Store{
+		buf:       make([]byte, capacity),
+		index:     make(map[uint64]uint32),
+		seed:      maphash.MakeSeed(),
+		OnEvicted: onEvicted,
+	}
+}
+
+type header struct {
+	hash           uint64
+	keyLen, valLen uint32
+}
+
+func (h header) size() uint64 {
+	return headerSize + uint64(h.keyLen) + uint64(h.valLen)
+}
+
+// read copies len(p) bytes from logical offset off, wrapping around the end
+// of the ring.
+func (s *Store) read(off uint64, p []byte) {
+	n := copy(p, s.buf[off%uint64(len(s.buf)):])
+	copy(p[n:], s.buf)
+}
+
+// write is the counterpart of read.
+func (s *Store) write(off uint64, p []byte) {
+	n := copy(s.buf[off%uint64(len(s.buf)):], p)
+	copy(s.buf, p[n:])
+}
+
+func (s *Store) readHeader(off uint64) header {
+	var b [headerSize]byte
+	s.read(off, b[:])
+	return header{
+		hash:   binary.LittleEndian.Uint64(b[0:]),
+		keyLen: binary.LittleEndian.Uint32(b[8:]),
+		valLen: binary.LittleEndian.Uint32(b[12:]),
+	}
+}
+
+// logical turns an offset from the index back into a logical offset, the
+// entry being somewhere between tail and head.
+func (s *Store) logical(pos uint32) uint64 {
+	c := uint64(len(s.buf))
+	off := s.tail - s.tail%c + uint64(pos)
+	if off < s.tail {
+		off += c
+	}
+	return off
+}
+
+// lookup returns the logical offset and header of key's live entry.
+func (s *Store) lookup(key string) (uint64, header, bool) {
+	h := maphash.String(s.seed, key)
+	pos, ok := s.index[h]
+	if !ok {
+		return 0, header{}, false
+	}
+	off := s.logical(pos)
+	hdr := s.readHeader(off)
+	if int(hdr.keyLen) != len(key) {
+		return 0, header{}, false
+	}
+	k := make([]byte, hdr.keyLen)
+	s.read(off+headerSize, k)
+	if string(k) != key {
+		// another key with the same hash, it owns the index slot
+		return 0, header{}, false
+	}
+	return off, hdr, true
+}
+
+// Get returns a copy of key's value.
+func (s *Store) Get(key string) (value []byte, ok bool) {
+	off, hdr, ok := s.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	value = make([]byte, hdr.valLen)
+	s.read(off+headerSize+uint64(hdr.keyLen), value)
+	return value, true
+}
+
+// Add writes key and value at the head of the ring, evicting the oldest
+// entries to make room. An entry larger than the ring is not stored.
+func (s *Store) Add(key string, value []byte) {
+	s.remove(key, false)
+	hdr := header{hash: maphash.String(s.seed, key), keyLen: uint32(len(key)), valLen: uint32(len(value))}
+	size := hdr.size()
+	if size > uint64(len(s.buf)) {
+		return
+	}
+	for s.head+size-s.tail > uint64(len(s.buf)) {
+		s.evictTail()
+	}
+
+	var b [headerSize]byte
+	binary.LittleEndian.PutUint64(b[0:], hdr.hash)
+	binary.LittleEndian.PutUint32(b[8:], hdr.keyLen)
+	binary.LittleEndian.PutUint32(b[12:], hdr.valLen)
+	s.write(s.head, b[:])
+	s.write(s.head+headerSize, []byte(key))
+	s.write(s.head+headerSize+uint64(hdr.keyLen), value)
+
+	if pos, taken := s.index[hdr.hash]; taken {
+		// another key with the same hash loses its index slot, and so
+		// drops out of the store
+		s.bytes -= s.liveBytes(s.readHeader(s.logical(pos)))
+	}
+	s.bytes += s.liveBytes(hdr)
+	s.index[hdr.hash] = uint32(s.head % uint64(len(s.buf)))
+	s.head += size
+}
+
+func (s *Store) liveBytes(hdr header) int64 {
+	return int64(hdr.keyLen) + int64(hdr.valLen)
+}
+
+// evictTail drops the entry at the tail, which is garbage unless the index
+// still points at it.
+func (s *Store) evictTail() {
+	off := s.tail
+	hdr := s.readHeader(off)
+	s.tail += hdr.size()
+	if !s.live(off, hdr) {
+		return
+	}
+	delete(s.index, hdr.hash)
+	s.bytes -= s.liveBytes(hdr)
+	if s.OnEvicted != nil {
+		s.OnEvicted(s.entry(off, hdr))
+	}
+}
+
+// live reports whether the entry at off is the one the index points at.
+func (s *Store) live(off uint64, hdr header) bool {
+	pos, ok := s.index[hdr.hash]
+	return ok && pos == uint32(off%uint64(len(s.buf)))
+}
+
+// entry returns a copy of the key and value of the entry at off.
+func (s *Store) entry(off uint64, hdr header) (string, []byte) {
+	key := make([]byte, hdr.keyLen)
+	value := make([]byte, hdr.valLen)
+	s.read(off+headerSize, key)
+	s.read(off+headerSize+uint64(hdr.keyLen), value)
+	return string(key), value
+}
+
+// RemoveOldest evicts the oldest live entry.
+func (s *Store) RemoveOldest() {
+	for n := len(s.index); n > 0 && len(s.index) == n; {
+		s.evictTail()
+	}
+}
+
+// Del removes key from the store. Its bytes stay in the ring until the
+// head wraps over them.
+func (s *Store) Del(key string) {
+	s.remove(key, true)
+}
+
+func (s *Store) remove(key string, notify bool) {
+	off, hdr, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	delete(s.index, hdr.hash)
+	s.bytes -= s.liveBytes(hdr)
+	if notify && s.OnEvicted != nil {
+		value := make([]byte, hdr.valLen)
+		s.read(off+headerSize+uint64(hdr.keyLen), value)
+		s.OnEvicted(key, value)
+	}
+}
+
+// Bytes returns the memory taken by the keys and values of live entries.
+func (s *Store) Bytes() int64 {
+	return s.bytes
+}
+
+// Len the number of live entries
+func (s *Store) Len() int {
+	return len(s.index)
+}
+
+// Walk calls fn for every live entry, oldest first. fn must not modify the
+// store.
+func (s *Store) Walk(fn func(key string, value []byte)) {
+	for off := s.tail; off < s.head; {
+		hdr := s.readHeader(off)
+		if s.live(off, hdr) {
+			fn(s.entry(off, hdr))
+		}
+		off += hdr.size()
+	}
+}
@@ -0,0 +1,108 @@
+package ringstore
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s := New(1<<10, nil)
+	s.Add("Tom", []byte("630"))
+	s.Add("Jack", []byte("589"))
+	if v, ok := s.Get("Tom"); !ok || string(v) != "630" {
+		t.Fatalf("Get(Tom) = %q, %v, want 630", v, ok)
+	}
+	s.Add("Tom", []byte("700"))
+	if v, ok := s.Get("Tom"); !ok || string(v) != "700" {
+		t.Fatalf("Get(Tom) after update = %q, %v, want 700", v, ok)
+	}
+	s.Del("Jack")
+	if _, ok := s.Get("Jack"); ok {
+		t.Fatalf("Jack was not deleted")
+	}
+	if s.Len() != 1 || s.Bytes() != int64(len("Tom")+len("700")) {
+		t.Fatalf("Len() = %d, Bytes() = %d", s.Len(), s.Bytes())
+	}
+}
+
+func TestEvictsOldest(t *testing.T) {
+	var evicted []string
+	// room for exactly four entries of 20 bytes
+	s := New(4*(headerSize+4), func(key string, value []byte) {
+		evicted = append(evicted, key)
+	})
+	for _, k := range []string{"key1", "key2", "key3"} {
+		s.Add(k, nil)
+	}
+	s.Add("key2", nil) // an update takes the fourth slot but does not notify
+	if len(evicted) != 0 || s.Len() != 3 {
+		t.Fatalf("evicted %v, Len() = %d after an update", evicted, s.Len())
+	}
+	// key1 is overwritten, the stale copy of key2 is skipped next
+	s.Add("key4", nil)
+	if !reflect.DeepEqual(evicted, []string{"key1"}) || s.Len() != 3 {
+		t.Fatalf("evicted %v, want [key1]", evicted)
+	}
+	s.RemoveOldest()
+	if !reflect.DeepEqual(evicted, []string{"key1", "key3"}) {
+		t.Fatalf("evicted %v, want [key1 key3]", evicted)
+	}
+	if _, ok := s.Get("key2"); !ok {
+		t.Fatalf("key2 was evicted")
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	s := New(32, nil)
+	s.Add("big", []byte(strings.Repeat("x", 32)))
+	if _, ok := s.Get("big"); ok || s.Len() != 0 {
+		t.Fatalf("an entry larger than the ring was stored")
+	}
+}
+
+// TestWrapAround checks every value read back against a map while entries
+// of random sizes wrap around a small ring many times.
+func TestWrapAround(t *testing.T) {
+	want := make(map[string]string)
+	s := New(200, func(key string, value []byte) {
+		if want[key] != string(value) {
+			t.Fatalf("evicted %s=%q, want %q", key, value, want[key])
+		}
+		delete(want, key)
+	})
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint(r.Intn(20))
+		switch r.Intn(4) {
+		case 0:
+			s.Del(key)
+		default:
+			value := strings.Repeat(key, r.Intn(20))
+			s.Add(key, []byte(value))
+			want[key] = value
+		}
+		if s.Len() != len(want) {
+			t.Fatalf("Len() = %d, want %d", s.Len(), len(want))
+		}
+	}
+	var bytes int64
+	for k, v := range want {
+		if got, ok := s.Get(k); !ok || string(got) != v {
+			t.Fatalf("Get(%s) = %q, %v, want %q", k, got, ok, v)
+		}
+		bytes += int64(len(k) + len(v))
+	}
+	if s.Bytes() != bytes {
+		t.Fatalf("Bytes() = %d, want %d", s.Bytes(), bytes)
+	}
+	walked := make(map[string]string)
+	s.Walk(func(key string, value []byte) {
+		walked[key] = string(value)
+	})
+	if !reflect.DeepEqual(walked, want) {
+		t.Fatalf("Walk() visited %v, want %v", walked, want)
+	}
+}
@@ -1,11 +1,30 @@
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
 
 type call struct {
-	wg  sync.WaitGroup
-	val interface{}
-	err error
+	done chan struct{} // 请求结束时关闭
+	val  interface{}
+	err  error
+
+	waiters int                // 仍在等待结果的调用方数量，由 Group.mu 保护
+	cancel  context.CancelFunc // 取消传给 fn 的 ctx
+}
+
+// panicError is the error of a call whose fn panicked. Each caller waiting
+// for the call panics with it again, in its own goroutine.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("singleflight: fn panicked: %v\n\n%s", p.value, p.stack)
 }
 
 type Group struct {
@@ -14,26 +33,70 @@ type Group struct {
 }
 
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext is like Do, but each caller stops waiting as soon as its own ctx
+// is done and gets ctx.Err() back. fn runs with a context detached from any
+// single caller, which is only cancelled once every caller has given up, so
+// one impatient caller never fails the call for the others.
+func (g *Group) DoContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
-	if c, ok := g.m[key]; ok {
-		g.mu.Unlock()
-		c.wg.Wait()         // 如果请求正在进行中，则等待
-		return c.val, c.err // 请求结束，返回结果
+	c, ok := g.m[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		var fnCtx context.Context
+		// 保留 ctx 中的值，但不继承发起者的取消和超时
+		fnCtx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		g.m[key] = c // 添加到 g.m，表明 key 已经有对应的请求在处理
+		go g.run(fnCtx, key, c, fn)
 	}
-	c := new(call)
-	c.wg.Add(1)  // 发起请求前加锁
-	g.m[key] = c // 添加到 g.m，表明 key 已经有对应的请求在处理
+	c.waiters++
 	g.mu.Unlock()
 
-	c.val, c.err = fn() // 调用 fn，发起请求
-	c.wg.Done()         // 请求结束
+	select {
+	case <-c.done:
+		// fn 在单独的 goroutine 里 panic，交给调用方自己的 goroutine 处理，例如 net/http 会 recover
+		if p, ok := c.err.(*panicError); ok {
+			panic(p)
+		}
+		return c.val, c.err // 请求结束，返回结果
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// 没有人再等这个结果了，取消请求，后来的调用方重新发起
+			c.cancel()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
 
-	g.mu.Lock()
-	delete(g.m, key) // 更新 g.m
-	g.mu.Unlock()
+// run calls fn for c. A panic in fn is recovered, since nothing up this
+// goroutine's stack would, and finishes the call with a panicError.
+func (g *Group) run(ctx context.Context, key string, c *call, fn func(context.Context) (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.val, c.err = nil, &panicError{value: r, stack: debug.Stack()}
+		}
+
+		g.mu.Lock()
+		if g.m[key] == c {
+			delete(g.m, key) // 更新 g.m
+		}
+		g.mu.Unlock()
 
-	return c.val, c.err // 返回结果
+		c.cancel()
+		close(c.done) // 请求结束
+	}()
+	c.val, c.err = fn(ctx) // 调用 fn，发起请求
 }
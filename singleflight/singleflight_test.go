@@ -0,0 +1,130 @@
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+	v, err := g.Do("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if v.(string) != "bar" || err != nil {
+		t.Errorf("Do = %v, %v, want bar, nil", v, err)
+	}
+}
+
+func TestDoDedup(t *testing.T) {
+	var g Group
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := g.Do("key", fn); v.(string) != "bar" || err != nil {
+				t.Errorf("Do = %v, %v, want bar, nil", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn called %d times, want 1", got)
+	}
+}
+
+func TestDoContextWaiterLeaves(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	var fnErr error
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "bar", nil
+		case <-ctx.Done():
+			fnErr = ctx.Err()
+			return nil, ctx.Err()
+		}
+	}
+
+	patient := make(chan interface{})
+	go func() {
+		v, _ := g.DoContext(context.Background(), "key", fn)
+		patient <- v
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.DoContext(ctx, "key", fn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("impatient caller got %v, want DeadlineExceeded", err)
+	}
+
+	close(release)
+	if v := <-patient; v != "bar" || fnErr != nil {
+		t.Fatalf("patient caller got %v (fn err %v), want bar", v, fnErr)
+	}
+}
+
+func TestDoContextAllWaitersLeave(t *testing.T) {
+	var g Group
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err := g.DoContext(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DoContext = %v, want Canceled", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("fn was not cancelled after its only caller left")
+	}
+}
+
+func TestDoContextPanic(t *testing.T) {
+	var g Group
+	fn := func(context.Context) (interface{}, error) {
+		panic("boom")
+	}
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("DoContext did not panic in the caller")
+				} else if err, ok := r.(error); !ok || !strings.Contains(err.Error(), "boom") {
+					t.Fatalf("DoContext panicked with %v, want fn's panic", r)
+				}
+			}()
+			g.DoContext(context.Background(), "key", fn)
+		}()
+	}
+	// the call is finished, a later caller runs fn again
+	v, err := g.DoContext(context.Background(), "key", func(context.Context) (interface{}, error) {
+		return "bar", nil
+	})
+	if v != "bar" || err != nil {
+		t.Fatalf("DoContext after a panic = %v, %v, want bar", v, err)
+	}
+}
@@ -0,0 +1,150 @@
+package GoDistributedCache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// A snapshot is
+//
+//	"GDCS" | version | created | entry... | 0 | crc32
+//
+// where created is when it was taken, big endian unix nanoseconds, and an entry is uvarint len(key) | key | uvarint len(value) | value |
+// varint expiry in unix nanoseconds, 0 for none. Keys are never empty, so
+// a 0 length ends the entries. The big endian IEEE CRC-32 covers every
+// byte before it.
+const (
+	snapshotMagic   = "GDCS"
+	snapshotVersion = 2
+)
+
+var (
+	// ErrBadSnapshot is returned by Restore for data that is not a
+	// complete snapshot written by Snapshot.
+	ErrBadSnapshot = errors.New("bad cache snapshot")
+	// ErrStaleSnapshot is returned by Restore for a snapshot taken longer
+	// ago than the Group's WithSnapshotMaxAge.
+	ErrStaleSnapshot = errors.New("cache snapshot too old")
+)
+
+// Snapshot writes the entries of the Group's main cache to w, together
+// with their expiry, one shard after another and each shard's oldest
+// first. Hot copies of other peers' keys are
+// left out, their owner can always serve them again.
+func (g *Group) Snapshot(w io.Writer) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	bw.Write(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+
+	var buf [binary.MaxVarintLen64]byte
+	err := g.mainCache.walkShards(func(keys []string, values []ByteView) error {
+		for i, key := range keys {
+			bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(key)))])
+			bw.WriteString(key)
+			bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(values[i].b)))])
+			bw.Write(values[i].b)
+			bw.Write(buf[:binary.PutVarint(buf[:], expireToNano(values[i].e))])
+		}
+		// bufio.Writer keeps the first write error, Flush reports it
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteByte(0)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// Restore adds the entries of a snapshot written by Snapshot to the main
+// cache in the order they were written, skipping those that have expired
+// since. Keys are spread over shards by a hash seeded per process, so the
+// LRU order is kept among keys that shared a shard, not across shards.
+// Nothing is restored from a truncated or corrupt snapshot, or from one
+// older than WithSnapshotMaxAge.
+func (g *Group) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+1+8+1+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrBadSnapshot
+	}
+	if v := data[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, v)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	type entry struct {
+		key   string
+		value ByteView
+	}
+	header := len(snapshotMagic) + 1
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(data[header:])))
+	if g.snapshotMaxAge > 0 && time.Since(created) > g.snapshotMaxAge {
+		return fmt.Errorf("%w: taken at %v", ErrStaleSnapshot, created)
+	}
+
+	var entries []entry
+	br := bytes.NewReader(body[header+8:])
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return ErrBadSnapshot
+		}
+		if n == 0 {
+			break
+		}
+		key, err := readSnapshotBytes(br, n)
+		if err != nil {
+			return err
+		}
+		if n, err = binary.ReadUvarint(br); err != nil {
+			return ErrBadSnapshot
+		}
+		value, err := readSnapshotBytes(br, n)
+		if err != nil {
+			return err
+		}
+		expire, err := binary.ReadVarint(br)
+		if err != nil {
+			return ErrBadSnapshot
+		}
+		entries = append(entries, entry{string(key), ByteView{b: value, e: expireFromNano(expire)}})
+	}
+	if br.Len() != 0 {
+		return ErrBadSnapshot
+	}
+
+	now := time.Now()
+	for _, ent := range entries {
+		if !ent.value.expired(now) {
+			g.dropFromDisk(ent.key)
+			g.populateCache(ent.key, ent.value)
+		}
+	}
+	return nil
+}
+
+func readSnapshotBytes(r *bytes.Reader, n uint64) ([]byte, error) {
+	if n > uint64(r.Len()) {
+		return nil, ErrBadSnapshot
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
@@ -0,0 +1,100 @@
+package GoDistributedCache
+
+import "sync/atomic"
+
+// Stats are per-group statistics, as returned by Group.Stats.
+type Stats struct {
+	Gets           int64 // any Get request, including from peers
+	CacheHits      int64 // Gets served straight from the cache
+	DiskHits       int64 // Loads served from the disk tier
+	Loads          int64 // Gets that missed the cache (Gets - CacheHits)
+	LoadsRun       int64 // Loads that actually ran after singleflight merged concurrent ones
+	PeerLoads      int64 // values fetched from the owning peer
+	PeerErrors     int64 // failed fetches from the owning peer
+	PeerRetries    int64 // peer requests sent again after a transport error
+	PeerHedges     int64 // peer fetches slow enough to race a local load
+	HedgeWins      int64 // races the local load won
+	LocalLoads     int64 // values loaded by this node's Getter
+	LocalLoadErrs  int64 // failed loads by this node's Getter
+	ServerRequests int64 // Gets that came over the network from peers
+}
+
+// Deduped returns how many Loads singleflight merged into another caller's load.
+func (s Stats) Deduped() int64 {
+	return s.Loads - s.LoadsRun
+}
+
+// CacheStats are statistics of one of a Group's caches.
+type CacheStats struct {
+	Bytes     int64 // keys and values currently held
+	MaxBytes  int64 // byte budget, 0 if unlimited
+	Items     int64
+	Gets      int64
+	Hits      int64
+	Evictions int64 // entries dropped to stay within the byte budget
+}
+
+// groupStats holds the live counters behind Stats. Gets and cache hits are
+// not among them: every Get counts them in the shard it looks up, under the
+// shard's lock, so parallel Gets share no counter.
+type groupStats struct {
+	diskHits       atomic.Int64
+	loads          atomic.Int64
+	loadsRun       atomic.Int64
+	peerLoads      atomic.Int64
+	peerErrors     atomic.Int64
+	peerRetries    atomic.Int64
+	peerHedges     atomic.Int64
+	hedgeWins      atomic.Int64
+	localLoads     atomic.Int64
+	localLoadErrs  atomic.Int64
+	serverRequests atomic.Int64
+}
+
+// Stats returns a snapshot of the group's counters.
+func (g *Group) Stats() Stats {
+	// 每个 Get 都先查一次 mainCache，没命中再查 hotCache
+	main, hot := g.mainCache.stats(), g.hotCache.stats()
+	return Stats{
+		Gets:           main.Gets,
+		CacheHits:      main.Hits + hot.Hits,
+		DiskHits:       g.stats.diskHits.Load(),
+		Loads:          g.stats.loads.Load(),
+		LoadsRun:       g.stats.loadsRun.Load(),
+		PeerLoads:      g.stats.peerLoads.Load(),
+		PeerErrors:     g.stats.peerErrors.Load(),
+		PeerRetries:    g.stats.peerRetries.Load(),
+		PeerHedges:     g.stats.peerHedges.Load(),
+		HedgeWins:      g.stats.hedgeWins.Load(),
+		LocalLoads:     g.stats.localLoads.Load(),
+		LocalLoadErrs:  g.stats.localLoadErrs.Load(),
+		ServerRequests: g.stats.serverRequests.Load(),
+	}
+}
+
+// CacheType selects one of a Group's caches.
+type CacheType int
+
+const (
+	// MainCache holds the keys this node owns.
+	MainCache CacheType = iota + 1
+	// HotCache holds copies of keys owned by other peers that are
+	// requested often on this node.
+	HotCache
+	// NegativeCache holds the keys that were recently not found.
+	NegativeCache
+)
+
+// CacheStats returns statistics about the provided cache within the group.
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.stats()
+	case HotCache:
+		return g.hotCache.stats()
+	case NegativeCache:
+		return g.negCache.stats()
+	default:
+		return CacheStats{}
+	}
+}